@@ -0,0 +1,78 @@
+package main
+
+// BlockStats represents DBS statistics of a single block
+type BlockStats struct {
+	BlockName          string `json:"block_name"`                     // block name
+	NumFiles           int64  `json:"num_file"`                       // output of filesummaries?block_name=xxx
+	NumEvents          int64  `json:"num_event"`                      // output of filesummaries?block_name=xxx
+	NumLumis           int64  `json:"num_lumi"`                       // output of filesummaries?block_name=xxx
+	NumFileLumis       int64  `json:"num_file_lumis"`                 // output of filelumis?block_name=xxx
+	Open               bool   `json:"open_for_writing"`               // output of blocks?dataset=xxx&detail=1
+	OriginSite         string `json:"origin_site_name"`               // output of blocks?dataset=xxx&detail=1
+	NumDuplicatedLumis int    `json:"num_duplicated_lumis,omitempty"` // block lumis which appear in dataset more than once
+	NumMissingLumis    int    `json:"num_missing_lumis,omitempty"`    // input block lumis missing in output dataset
+	Failed             bool   `json:"failed,omitempty"`               // block we were unable to fetch from DBS
+}
+
+// helper function to construct per-block statistics of DBS record from
+// blocks details, blocks run/lumi records and blocks filesummaries
+func blockStats(rec *DBSRecord, details []DBSBlock, failed []string) []BlockStats {
+	dmap := make(map[string]DBSBlock)
+	for _, d := range details {
+		dmap[d.BlockName] = d
+	}
+	var out []BlockStats
+	for i, blk := range rec.blockNames {
+		b := BlockStats{
+			BlockName:  blk,
+			Open:       dmap[blk].OpenForWriting != 0,
+			OriginSite: dmap[blk].OriginSite,
+			Failed:     InList(blk, failed),
+		}
+		if i < len(rec.blockSummaries) {
+			b.NumFiles = rec.blockSummaries[i].NumFile
+			b.NumEvents = rec.blockSummaries[i].NumEvent
+			b.NumLumis = rec.blockSummaries[i].NumLumi
+		}
+		if i < len(rec.blockLumis) {
+			b.NumFileLumis = int64(len(rec.blockLumis[i]))
+			dups := make(RunLumiSet)
+			for _, r := range rec.blockLumis[i] {
+				if rec.dupLumis.Contains(r.Run, r.Lumi) {
+					dups.Add(r.Run, r.Lumi)
+				}
+			}
+			b.NumDuplicatedLumis = dups.Len()
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// helper function to get per-block statistics of input dataset along with
+// number of (accepted by request restrictions) block lumis which are
+// missing in output dataset
+func inputBlockStats(restrictions InputRestrictions, istats, ostats *DBSRecord) []BlockStats {
+	if len(istats.Blocks) == 0 {
+		return nil
+	}
+	out := make([]BlockStats, len(istats.Blocks))
+	copy(out, istats.Blocks)
+	for i := range out {
+		if i >= len(istats.blockLumis) || !restrictions.acceptBlock(out[i].BlockName) {
+			continue
+		}
+		missing := make(RunLumiSet)
+		for _, r := range istats.blockLumis[i] {
+			// lumis present only in invalid files are lost, not missing
+			if !restrictions.acceptLumi(r.Run, r.Lumi) || !istats.lumis.Contains(r.Run, r.Lumi) {
+				continue
+			}
+			if !ostats.lumis.Contains(r.Run, r.Lumi) {
+				missing.Add(r.Run, r.Lumi)
+			}
+		}
+		out[i].NumMissingLumis = missing.Len()
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// TestDbsStatsBlocks tests that per-block statistics are built from single
+// call of blocks API with details
+func TestDbsStatsBlocks(t *testing.T) {
+	testPool()
+	apis := testDatasetApis()
+	// blocks without details are not served, i.e. blocks are fetched once
+	delete(apis, "blocks?dataset=%2FA%2FB%2FRAW")
+	apis["blocks?dataset=%2FA%2FB%2FRAW&detail=1"] = []any{
+		DBSBlock{BlockName: "/A/B/RAW#1", OpenForWriting: 1, OriginSite: "T1_US_FNAL_Disk"},
+	}
+	srv := fakeDBSApis(apis)
+	defer srv.Close()
+
+	rec, err := dbsStats(context.Background(), srv.URL, "/A/B/RAW", Details{Blocks: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []BlockStats{{
+		BlockName:    "/A/B/RAW#1",
+		NumFiles:     2,
+		NumEvents:    30,
+		NumLumis:     3,
+		NumFileLumis: 4,
+		Open:         true,
+		OriginSite:   "T1_US_FNAL_Disk",
+	}}
+	if !reflect.DeepEqual(rec.Blocks, expect) {
+		t.Errorf("wrong blocks stats %+v, expect %+v", rec.Blocks, expect)
+	}
+}
+
+// TestBlockStats tests per-block statistics of DBS record
+func TestBlockStats(t *testing.T) {
+	rec := testInputRecord()
+	rec.blockLumis[1] = append(rec.blockLumis[1], RunLumi{Run: 1, Lumi: 4})
+	rec.dupLumis = make(RunLumiSet)
+	rec.dupLumis.Add(1, 4)
+	details := []DBSBlock{{BlockName: "/A/B/RAW#1", OriginSite: "T1_US_FNAL_Disk"}}
+	failed := []string{"/A/B/RAW#2"}
+	expect := []BlockStats{
+		{BlockName: "/A/B/RAW#1", NumFiles: 1, NumEvents: 40, NumLumis: 4, NumFileLumis: 4, OriginSite: "T1_US_FNAL_Disk", NumDuplicatedLumis: 1},
+		{BlockName: "/A/B/RAW#2", NumFiles: 1, NumEvents: 30, NumLumis: 2, NumFileLumis: 3, NumDuplicatedLumis: 1, Failed: true},
+	}
+	if blocks := blockStats(rec, details, failed); !reflect.DeepEqual(blocks, expect) {
+		t.Errorf("wrong blocks stats %+v, expect %+v", blocks, expect)
+	}
+}
+
+// TestInputBlockStats tests number of input block lumis missing in output
+// dataset with respect to request restrictions
+func TestInputBlockStats(t *testing.T) {
+	istats := testInputRecord()
+	istats.Blocks = blockStats(istats, nil, nil)
+	// lumi 2:3 is present only in invalid file and it is not missing
+	istats.blockLumis[1] = append(istats.blockLumis[1], RunLumi{Run: 2, Lumi: 3, LFN: "/c.root"})
+	ostats := &DBSRecord{lumis: make(RunLumiSet)}
+	ostats.lumis.Add(1, 1)
+	ostats.lumis.Add(2, 1)
+	tests := []struct {
+		name         string
+		restrictions InputRestrictions
+		missing      []int
+	}{
+		{"no restrictions", InputRestrictions{}, []int{3, 1}},
+		{"run whitelist", InputRestrictions{RunWhitelist: []int{2}}, []int{0, 1}},
+		{"lumi list", InputRestrictions{LumiList: LumiMask{1: {{1, 2}}}}, []int{1, 0}},
+		{"block blacklist", InputRestrictions{BlockBlacklist: []string{"/A/B/RAW#1"}}, []int{0, 1}},
+	}
+	for _, tt := range tests {
+		blocks := inputBlockStats(tt.restrictions, istats, ostats)
+		if len(blocks) != len(tt.missing) {
+			t.Fatalf("%s: wrong number of blocks %d", tt.name, len(blocks))
+		}
+		for i, b := range blocks {
+			if b.NumMissingLumis != tt.missing[i] {
+				t.Errorf("%s: wrong number of missing lumis %d of %s, expect %d", tt.name, b.NumMissingLumis, b.BlockName, tt.missing[i])
+			}
+		}
+	}
+	if istats.Blocks[0].NumMissingLumis != 0 {
+		t.Error("input blocks stats are modified")
+	}
+	if blocks := inputBlockStats(InputRestrictions{}, &DBSRecord{}, ostats); blocks != nil {
+		t.Errorf("unexpected blocks stats %+v without input blocks", blocks)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// helper function to get parent dataset of each output dataset of the
+// request. For TaskChain/StepChain requests the parentage is taken from
+// ReqMgr2 ChainParentageMap, if it is not available the output datasets are
+// assigned to tasks by their processed dataset name (AcquisitionEra,
+// ProcessingString and ProcessingVersion of the task) and the parent is
+// found by walking up InputTask/InputStep chain to the nearest dataset,
+// i.e. the parent may be an intermediate output of the chain. The output
+// datasets we can not resolve are compared with request input dataset.
+func parentDatasets(rec *ReqMgrRecord) map[string]string {
+	input := rec.inputDataset()
+	parents := make(map[string]string)
+	for _, output := range rec.OutputDatasets {
+		parents[output] = input
+	}
+	if len(rec.ChainParentageMap) != 0 {
+		for _, entry := range rec.ChainParentageMap {
+			if entry.ParentDset == "" || entry.ParentDset == "None" {
+				continue
+			}
+			for _, child := range entry.ChildDsets {
+				if _, ok := parents[child]; ok {
+					parents[child] = entry.ParentDset
+				}
+			}
+		}
+		return parents
+	}
+	if len(rec.Tasks) < 2 {
+		return parents
+	}
+
+	tasks := make(map[string]*Task)
+	for i := range rec.Tasks {
+		tasks[rec.Tasks[i].Name()] = &rec.Tasks[i]
+	}
+	outputs := taskOutputs(rec)
+	for name, datasets := range outputs {
+		parent := taskParentDataset(tasks[name], tasks, outputs)
+		if parent == "" {
+			continue
+		}
+		for _, dataset := range datasets {
+			parents[dataset] = parent
+		}
+	}
+	return parents
+}
+
+// helper function to assign request output datasets to its tasks, the
+// datasets which match more than one task are not assigned
+func taskOutputs(rec *ReqMgrRecord) map[string][]string {
+	outputs := make(map[string][]string)
+	for _, dataset := range rec.OutputDatasets {
+		arr := strings.Split(dataset, "/")
+		if len(arr) != 4 {
+			continue
+		}
+		var matches []string
+		for _, task := range rec.Tasks {
+			if !task.Kept() || task.AcquisitionEra == "" || task.ProcessingString == "" {
+				continue
+			}
+			name := fmt.Sprintf("%s-%s-v%d", task.AcquisitionEra, task.ProcessingString, task.ProcessingVersion)
+			if name == arr[2] {
+				matches = append(matches, task.Name())
+			}
+		}
+		if len(matches) == 1 {
+			outputs[matches[0]] = append(outputs[matches[0]], dataset)
+		}
+	}
+	return outputs
+}
+
+// helper function to find parent dataset of given task, it returns empty
+// string if parent dataset can not be resolved
+func taskParentDataset(task *Task, tasks map[string]*Task, outputs map[string][]string) string {
+	for depth := 0; task != nil && depth <= len(tasks); depth++ {
+		if task.InputDataset != "" {
+			return task.InputDataset
+		}
+		parent, ok := tasks[task.Parent()]
+		if !ok {
+			return ""
+		}
+		datasets := outputs[parent.Name()]
+		if len(datasets) == 1 {
+			return datasets[0]
+		}
+		if len(datasets) > 1 {
+			// use output module of parent task to choose among its datasets,
+			// e.g. AODSIMoutput module produces AODSIM data-tier
+			tier := strings.TrimSuffix(task.InputFromOutputModule, "output")
+			for _, dataset := range datasets {
+				if dataTier(dataset) == tier {
+					return dataset
+				}
+			}
+			return ""
+		}
+		// parent task does not keep its output, walk up the chain
+		task = parent
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TaskChain request: Task1 produces AOD and RECO, Task2 processes RECO into
+// MINIAOD, Task3 does not keep its output and Task4 produces NANOAOD from it
+const testTaskChain = `{"result": [{"wf": {
+	"RequestType": "TaskChain",
+	"TaskChain": 4,
+	"OutputDatasets": ["/A/Era-P1-v1/AOD", "/A/Era-P1-v1/RECO", "/A/Era-P2-v1/MINIAOD", "/A/Era-P4-v1/NANOAOD", "/A/Other-v1/AOD"],
+	"Task1": {"TaskName": "Reco", "InputDataset": "/A/B/RAW", "AcquisitionEra": "Era", "ProcessingString": "P1", "ProcessingVersion": 1, "RunWhitelist": [1, 2]},
+	"Task2": {"TaskName": "Mini", "InputTask": "Reco", "InputFromOutputModule": "RECOoutput", "AcquisitionEra": "Era", "ProcessingString": "P2", "ProcessingVersion": 1},
+	"Task3": {"TaskName": "Skim", "InputTask": "Mini", "InputFromOutputModule": "MINIAODoutput", "KeepOutput": false, "AcquisitionEra": "Era", "ProcessingString": "P3", "ProcessingVersion": 1},
+	"Task4": {"TaskName": "Nano", "InputTask": "Skim", "InputFromOutputModule": "SKIMoutput", "AcquisitionEra": "Era", "ProcessingString": "P4", "ProcessingVersion": 1}
+}}]}`
+
+// StepChain request from scratch: GEN and DIGI steps do not keep their
+// output, RECO produces AODSIM and MINI produces MINIAODSIM from it
+const testStepChain = `{"result": [{"wf": {
+	"RequestType": "StepChain",
+	"StepChain": 4,
+	"RequestNumEvents": 1000,
+	"OutputDatasets": ["/A/Era-P3-v2/AODSIM", "/A/Era-P4-v2/MINIAODSIM"],
+	"Step1": {"StepName": "GEN", "KeepOutput": false, "AcquisitionEra": "Era", "ProcessingString": "P1", "ProcessingVersion": 2, "RequestNumEvents": 1000},
+	"Step2": {"StepName": "DIGI", "InputStep": "GEN", "InputFromOutputModule": "RAWSIMoutput", "KeepOutput": false, "AcquisitionEra": "Era", "ProcessingString": "P2", "ProcessingVersion": 2},
+	"Step3": {"StepName": "RECO", "InputStep": "DIGI", "InputFromOutputModule": "PREMIXRAWoutput", "AcquisitionEra": "Era", "ProcessingString": "P3", "ProcessingVersion": 2},
+	"Step4": {"StepName": "MINI", "InputStep": "RECO", "InputFromOutputModule": "AODSIMoutput", "AcquisitionEra": "Era", "ProcessingString": "P4", "ProcessingVersion": 2}
+}}]}`
+
+// StepChain request with input dataset whose steps share processed dataset
+// name, the parentage is provided by ChainParentageMap
+const testChainParentage = `{"result": [{"wf": {
+	"RequestType": "StepChain",
+	"InputDataset": "/A/B/GEN-SIM",
+	"OutputDatasets": ["/A/Era-P-v1/AODSIM", "/A/Era-P-v1/MINIAODSIM", "/A/Era-P-v1/NANOAODSIM"],
+	"Step1": {"StepName": "RECO", "InputDataset": "/A/B/GEN-SIM", "AcquisitionEra": "Era", "ProcessingString": "P", "ProcessingVersion": 1},
+	"Step2": {"StepName": "MINI", "InputStep": "RECO", "AcquisitionEra": "Era", "ProcessingString": "P", "ProcessingVersion": 1},
+	"Step3": {"StepName": "NANO", "InputStep": "MINI", "AcquisitionEra": "Era", "ProcessingString": "P", "ProcessingVersion": 1},
+	"ChainParentageMap": {
+		"Step1": {"ParentDset": "/A/B/GEN-SIM", "ChildDsets": ["/A/Era-P-v1/AODSIM"]},
+		"Step2": {"ParentDset": "/A/Era-P-v1/AODSIM", "ChildDsets": ["/A/Era-P-v1/MINIAODSIM"]},
+		"Step3": {"ParentDset": "/A/Era-P-v1/MINIAODSIM", "ChildDsets": ["/A/Era-P-v1/NANOAODSIM"]}
+	}
+}}]}`
+
+// TestParentDatasets tests parentage of output datasets of TaskChain and
+// StepChain requests
+func TestParentDatasets(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		parents map[string]string
+	}{
+		{"TaskChain", testTaskChain, map[string]string{
+			"/A/Era-P1-v1/AOD":     "/A/B/RAW",
+			"/A/Era-P1-v1/RECO":    "/A/B/RAW",
+			"/A/Era-P2-v1/MINIAOD": "/A/Era-P1-v1/RECO",
+			// Skim task does not keep its output, the parent is its input
+			"/A/Era-P4-v1/NANOAOD": "/A/Era-P2-v1/MINIAOD",
+			// dataset which does not match any task is compared with input
+			"/A/Other-v1/AOD": "/A/B/RAW",
+		}},
+		{"StepChain", testStepChain, map[string]string{
+			"/A/Era-P3-v2/AODSIM":     "",
+			"/A/Era-P4-v2/MINIAODSIM": "/A/Era-P3-v2/AODSIM",
+		}},
+		{"ChainParentageMap", testChainParentage, map[string]string{
+			"/A/Era-P-v1/AODSIM":     "/A/B/GEN-SIM",
+			"/A/Era-P-v1/MINIAODSIM": "/A/Era-P-v1/AODSIM",
+			"/A/Era-P-v1/NANOAODSIM": "/A/Era-P-v1/MINIAODSIM",
+		}},
+	}
+	for _, tt := range tests {
+		rec, err := parseReqMgr([]byte(tt.data), "wf", false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if parents := parentDatasets(rec); !reflect.DeepEqual(parents, tt.parents) {
+			t.Errorf("%s: wrong parents %v, expect %v", tt.name, parents, tt.parents)
+		}
+	}
+}
+
+// TestChainParentageAmbiguous tests that output datasets of steps which share
+// processed dataset name are compared with request input dataset when
+// ChainParentageMap is not provided
+func TestChainParentageAmbiguous(t *testing.T) {
+	rec, err := parseReqMgr([]byte(testChainParentage), "wf", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.ChainParentageMap = nil
+	for output, parent := range parentDatasets(rec) {
+		if parent != "/A/B/GEN-SIM" {
+			t.Errorf("wrong parent %s of %s", parent, output)
+		}
+	}
+}
+
+// TestReqMgrTasks tests parsing of TaskChain tasks and StepChain steps
+func TestReqMgrTasks(t *testing.T) {
+	data := `{"result": [{"wf": {
+		"RequestType": "TaskChain",
+		"Task10": {"TaskName": "T10", "InputTask": "T2"},
+		"Task2": {"TaskName": "T2", "InputTask": "T1", "EventsPerLumi": {"T2": 100}, "MCPileup": "/MinBias/PU/GEN-SIM"},
+		"Task1": {"TaskName": "T1", "InputDataset": "/A/B/RAW", "RunWhitelist": [1], "FilterEfficiency": 0.5},
+		"TaskChain": 3,
+		"StepName": "not a step"
+	}}]}`
+	rec, err := parseReqMgr([]byte(data), "wf", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, task := range rec.Tasks {
+		keys = append(keys, task.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"Task1", "Task2", "Task10"}) {
+		t.Fatalf("wrong tasks order %v", keys)
+	}
+	if rec.inputDataset() != "/A/B/RAW" || rec.filterEfficiency() != 0.5 {
+		t.Errorf("wrong input dataset %s or filter efficiency %v", rec.inputDataset(), rec.filterEfficiency())
+	}
+	if restrictions := rec.inputRestrictions(); !reflect.DeepEqual(restrictions.RunWhitelist, []int{1}) {
+		t.Errorf("wrong input restrictions %+v", restrictions)
+	}
+	if rec.Tasks[1].EventsPerLumi != 0 || rec.Tasks[1].MCPileup != "/MinBias/PU/GEN-SIM" || rec.Tasks[2].Parent() != "T2" {
+		t.Errorf("wrong tasks %+v", rec.Tasks)
+	}
+}
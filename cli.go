@@ -1,131 +1,269 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
-	"strings"
+	"sync"
 	"time"
 )
 
 // Record represents output record from checker
 type Record struct {
-	Workflow        string
-	TotalInputLumis int
-	InputDataset    string
-	OutputDataset   string
-	InputStats      DBSRecord
-	OutputStats     DBSRecord
-	Status          string
-	ElapsedTime     float64
+	Workflow         string
+	TotalInputLumis  int
+	RequestNumEvents int64 `json:",omitempty"`
+	InputDataset     string
+	OutputDataset    string
+	InputStats       DBSRecord
+	OutputStats      DBSRecord
+	ExpectedStats    *ExpectedStats `json:",omitempty"`
+	Completion       float64        `json:",omitempty"`
+	Status           string
+	Checks           []RuleResult
+	LumiDiff         *LumiDiff      `json:",omitempty"`
+	PileupStats      []PileupRecord `json:",omitempty"`
+	FailedBlocks     []string       `json:",omitempty"`
+	Error            string         `json:",omitempty"`
+	ErrorCode        string         `json:",omitempty"`
+	ElapsedTime      float64
 }
 
-// helper function to compare input/output dbs record stats
-func compareStats(istats, ostats *DBSRecord) string {
-	var out []string
-	if istats.NumLumis != ostats.NumLumis {
-		out = append(out, fmt.Sprintf("number of lumis differ %d != %d", istats.NumLumis, ostats.NumLumis))
+// helper function to get completion percentage of output dataset, i.e. ratio
+// of output events to expected number of events
+func completion(rec *Record) float64 {
+	if rec.ExpectedStats == nil || rec.ExpectedStats.NumEvents == 0 {
+		return 0
 	}
-	if istats.NumEvents != ostats.NumEvents {
-		out = append(out, fmt.Sprintf("number of events differ %d != %d", istats.NumEvents, ostats.NumEvents))
-	}
-	msg := "OK"
-	if len(out) != 0 {
-		msg = "WARNING: " + strings.Join(out, ", ")
-	}
-	//     if istats.NumInvalidFiles != ostats.NumInvalidFiles {
-	//         msg = fmt.Sprintf("%s, but some files were invalidated", msg)
-	//     }
-	return msg
+	return 100 * float64(rec.OutputStats.NumEvents) / float64(rec.ExpectedStats.NumEvents)
 }
 
-// helper function to concurrently check DBS infor for given list of workflows
-func concurrentCheck(wflows []string, verbose bool) ([]Record, error) {
+// default number of workflows checked concurrently
+const defaultMaxWorkflows = 10
+
+// helper function to concurrently check DBS infor for given list of workflows.
+// The workflows are processed by bounded number of workers and their records
+// are returned in order of workflows, the workflows which fail to be checked
+// are reported by error records.
+func concurrentCheck(ctx context.Context, wflows []string, wsrc WorkflowSource, dsrc DatasetStatsSource, verbose bool) ([]Record, error) {
 	time0 := time.Now()
-	ch := make(chan []Record)
-	defer close(ch)
-	umap := SyncMap{}
-	for _, w := range wflows {
-		umap.Store(w, true)
-		go func(wflow string, c chan<- []Record) {
-			records, err := check(wflow, verbose)
-			if err != nil {
-				umap.Store(wflow, false)
-				log.Printf("fail to process %s, error %v", wflow, err)
+	workers := Config.MaxWorkflows
+	if workers <= 0 {
+		workers = defaultMaxWorkflows
+	}
+	if workers > len(wflows) {
+		workers = len(wflows)
+	}
+
+	// pileup datasets are usually shared by workflows, we fetch them once
+	dsrc = newPileupCache(dsrc)
+
+	// each worker stores results of a workflow in its own slot, this way
+	// results are collected in workflows order
+	results := make([][]Record, len(wflows))
+	errs := make([]error, len(wflows))
+	elapsed := make([]float64, len(wflows))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				results[idx], errs[idx] = check(ctx, wflows[idx], wsrc, dsrc, verbose)
+				elapsed[idx] = time.Since(time0).Seconds()
 			}
-			c <- records
-		}(w, ch)
-		/*
-			// usage of pool provides controlled (fixed size) environment to call DBS
-			// where at most we will place number of calls limited by max pool size
-			pool.Submit(func() {
-				records, err := check(w, verbose)
-				if err != nil {
-					umap.Store(w, false)
-					log.Printf("fail to process %s, error %v", w, err)
-				}
-				ch <- records
-			})
-		*/
+		}()
+	}
+	for idx := range wflows {
+		if ctx.Err() != nil {
+			// workflows we did not start are reported with context error
+			errs[idx] = ctx.Err()
+			continue
+		}
+		jobs <- idx
 	}
+	close(jobs)
+	wg.Wait()
 
-	exit := false
 	var out []Record
-	for {
-		select {
-		case records := <-ch:
-			for _, r := range records {
-				r.ElapsedTime = time.Since(time0).Seconds()
-				out = append(out, r)
-				umap.Delete(r.Workflow)
-			}
-		default:
-			if umap.Len() == 0 {
-				exit = true
-			}
-			time.Sleep(time.Duration(10) * time.Millisecond) // wait for response
+	for idx, wflow := range wflows {
+		for _, r := range results[idx] {
+			r.ElapsedTime = elapsed[idx]
+			out = append(out, r)
 		}
-		if exit {
-			break
+		if errs[idx] != nil {
+			log.Printf("fail to process %s, error %v", wflow, errs[idx])
+			rec := errorRecord(wflow, errs[idx])
+			rec.ElapsedTime = elapsed[idx]
+			out = append(out, rec)
 		}
 	}
 	return out, nil
 }
 
-// helper function to check workflow against DBS
-func check(workflow string, verbose bool) ([]Record, error) {
+// helper function to construct record of workflow we fail to check, the
+// record carries error message and machine-readable error code
+func errorRecord(workflow string, err error) Record {
+	return Record{
+		Workflow:  workflow,
+		Status:    StatusError,
+		Error:     err.Error(),
+		ErrorCode: errorCode(err),
+	}
+}
+
+// helper function to count error records of workflows we fail to check
+func failedRecords(records []Record) int {
+	count := 0
+	for _, r := range records {
+		if r.Error != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// default deadline of workflow check
+const defaultWorkflowTimeout = 10 * time.Minute
+
+// helper function to get deadline of workflow check from server configuration
+func workflowTimeout() time.Duration {
+	if Config.WorkflowTimeout > 0 {
+		return time.Duration(Config.WorkflowTimeout) * time.Second
+	}
+	return defaultWorkflowTimeout
+}
+
+// helper function to check workflow against DBS, all upstream calls are
+// cancelled when given context is done or workflow deadline is exceeded
+func check(ctx context.Context, workflow string, wsrc WorkflowSource, dsrc DatasetStatsSource, verbose bool) ([]Record, error) {
 	time0 := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, workflowTimeout())
+	defer cancel()
 	var out []Record
-	rec, err := callReqMgr(workflow, verbose)
+	rec, err := wsrc.Workflow(ctx, workflow)
 	if err != nil {
-		fmt.Printf("ERROR: unable to get ReqMgr data for %s, %v", workflow, err)
-		return out, err
+		log.Printf("ERROR: unable to get ReqMgr data for %s, %v", workflow, err)
+		return out, &CheckError{Service: ServiceReqMgr, Err: err}
+	}
+	if len(rec.OutputDatasets) == 0 {
+		// workflow without output datasets, e.g. not yet assigned one, has
+		// nothing to check, we report it with warning instead of omitting it
+		r := Record{
+			Workflow:         workflow,
+			TotalInputLumis:  rec.TotalInputLumis,
+			RequestNumEvents: rec.requestNumEvents(),
+			InputDataset:     rec.inputDataset(),
+			Checks:           []RuleResult{{Rule: "output_datasets", Severity: StatusWarning, Expected: 1, Actual: 0}},
+		}
+		r.Status = recordStatus(r.Checks)
+		r.ElapsedTime = time.Since(time0).Seconds()
+		return append(out, r), nil
 	}
 
-	// extract from JSON TotalInputLumis, InputDataset, and list of OutputDatasets
-	input := rec.InputDataset
-	if input == "" {
-		input = rec.Task1.InputDataset
+	// DBS stats of datasets along with blocks we fail to fetch from DBS,
+	// each dataset is fetched once since intermediate outputs of
+	// TaskChain/StepChain requests can be parents of other outputs
+	dbsRecords := make(map[string]*DBSRecord)
+	dbsFailedBlocks := make(map[string][]string)
+	datasetStats := func(dataset string) (*DBSRecord, error) {
+		if r, ok := dbsRecords[dataset]; ok {
+			return r, nil
+		}
+		r, err := dsrc.DatasetStats(ctx, dataset)
+		if ctx.Err() != nil {
+			// blocks failed due to cancellation are not partial results
+			return nil, &CheckError{Service: ServiceDBS, Err: ctx.Err()}
+		}
+		if err != nil {
+			log.Printf("ERROR: unable to get DBS data for %s, %v", dataset, err)
+			var berr *BlocksError
+			if !errors.As(err, &berr) {
+				return nil, &CheckError{Service: ServiceDBS, Err: err}
+			}
+			dbsFailedBlocks[dataset] = berr.Blocks
+		}
+		dbsRecords[dataset] = r
+		return r, nil
 	}
-	dbsInputRec, err := dbsStats(input, verbose)
+
+	pileups, err := pileupStats(ctx, rec, dsrc)
 	if err != nil {
-		fmt.Printf("ERROR: unable to get DBS data for %s, %v", input, err)
-		return out, err
+		log.Printf("ERROR: %v", err)
+		return out, &CheckError{Service: ServiceDBS, Err: err}
 	}
+
+	// extract from JSON TotalInputLumis, InputDataset, and list of OutputDatasets
+	input := rec.inputDataset()
+	parents := parentDatasets(rec)
 	for _, output := range rec.OutputDatasets {
-		dbsOutputRec, err := dbsStats(output, verbose)
+		parent := parents[output]
+		dbsOutputRec, err := datasetStats(output)
 		if err != nil {
-			fmt.Printf("ERROR: unable to get DBS data for %s, %v", output, err)
 			return out, err
 		}
+		if parent == "" {
+			// MonteCarlo from scratch, compare output with request parameters
+			rec := Record{
+				Workflow:         workflow,
+				TotalInputLumis:  rec.TotalInputLumis,
+				RequestNumEvents: rec.requestNumEvents(),
+				OutputDataset:    output,
+				OutputStats:      *dbsOutputRec,
+				ExpectedStats:    mcExpectedStats(rec),
+				PileupStats:      pileups,
+				FailedBlocks:     dbsFailedBlocks[output],
+			}
+			rec.Completion = completion(&rec)
+			rec.Checks, rec.Status = evalRules(StatusRules, &rec)
+			rec.ElapsedTime = time.Since(time0).Seconds()
+			out = append(out, rec)
+			continue
+		}
+		dbsInputRec, err := datasetStats(parent)
+		if err != nil {
+			return out, err
+		}
+		var failedBlocks []string
+		failedBlocks = append(failedBlocks, dbsFailedBlocks[parent]...)
+		failedBlocks = append(failedBlocks, dbsFailedBlocks[output]...)
+
+		// request restrictions apply only to request input dataset
+		var restrictions InputRestrictions
+		if parent == input {
+			restrictions = rec.inputRestrictions()
+		}
 		rec := Record{
-			Workflow:        workflow,
-			TotalInputLumis: rec.TotalInputLumis,
-			InputDataset:    input,
-			OutputDataset:   output,
-			InputStats:      *dbsInputRec,
-			OutputStats:     *dbsOutputRec,
-			Status:          compareStats(dbsInputRec, dbsOutputRec),
+			Workflow:         workflow,
+			TotalInputLumis:  rec.TotalInputLumis,
+			RequestNumEvents: rec.RequestNumEvents,
+			InputDataset:     parent,
+			OutputDataset:    output,
+			InputStats:       *dbsInputRec,
+			OutputStats:      *dbsOutputRec,
+			ExpectedStats:    expectedStats(restrictions, rec.RequestNumEvents, dbsInputRec),
+			LumiDiff:         lumiDiff(restrictions, dbsInputRec, dbsOutputRec),
+			PileupStats:      pileups,
+		}
+		lineage, err := dsrc.DatasetLineage(ctx, output, parent, dbsOutputRec.blockNames)
+		if ctx.Err() != nil {
+			// blocks failed due to cancellation are not partial results
+			return out, &CheckError{Service: ServiceDBS, Err: ctx.Err()}
+		}
+		if err != nil {
+			log.Printf("ERROR: unable to get DBS lineage of %s, %v", output, err)
+			var berr *BlocksError
+			if !errors.As(err, &berr) {
+				return out, &CheckError{Service: ServiceDBS, Err: err}
+			}
+			failedBlocks = append(failedBlocks, berr.Blocks...)
 		}
+		rec.OutputStats.Lineage = lineage
+		rec.InputStats.Blocks = inputBlockStats(restrictions, dbsInputRec, dbsOutputRec)
+		rec.FailedBlocks = Set(failedBlocks)
+		rec.Completion = completion(&rec)
+		rec.Checks, rec.Status = evalRules(StatusRules, &rec)
 		rec.ElapsedTime = time.Since(time0).Seconds()
 		out = append(out, rec)
 	}
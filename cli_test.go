@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSource implements WorkflowSource and DatasetStatsSource interfaces
+// for workflows without output datasets
+type testSource struct{}
+
+// Workflow implements WorkflowSource interface
+func (s testSource) Workflow(ctx context.Context, name string) (*ReqMgrRecord, error) {
+	if name == "bad" {
+		return nil, fmt.Errorf("%s: %w", name, ErrWorkflowNotFound)
+	}
+	return &ReqMgrRecord{}, nil
+}
+
+// DatasetStats implements DatasetStatsSource interface
+func (s testSource) DatasetStats(ctx context.Context, dataset string) (*DBSRecord, error) {
+	return &DBSRecord{}, nil
+}
+
+// PileupStats implements DatasetStatsSource interface
+func (s testSource) PileupStats(ctx context.Context, dataset string) (*PileupRecord, error) {
+	return &PileupRecord{}, nil
+}
+
+// DatasetLineage implements DatasetStatsSource interface
+func (s testSource) DatasetLineage(ctx context.Context, dataset, parent string, blocks []string) (*Lineage, error) {
+	return &Lineage{}, nil
+}
+
+// TestConcurrentCheck tests that workflows without output datasets do not
+// block concurrent check and every workflow is reported in workflows order
+func TestConcurrentCheck(t *testing.T) {
+	var wflows []string
+	for i := 0; i < 50; i++ {
+		wflows = append(wflows, fmt.Sprintf("wf%d", i))
+	}
+	wflows = append(wflows, "bad")
+	src := testSource{}
+	out, err := concurrentCheck(context.Background(), wflows, src, src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(wflows) {
+		t.Fatalf("wrong number of records %d, expect %d", len(out), len(wflows))
+	}
+	for i, r := range out {
+		status, code := StatusWarning, ""
+		if r.Workflow == "bad" {
+			status, code = StatusError, ErrCodeReqMgrNotFound
+		}
+		if r.Workflow != wflows[i] || r.Status != status || r.ErrorCode != code {
+			t.Errorf("unexpected record %+v", r)
+		}
+	}
+}
+
+// TestErrorCode tests error codes of workflow check errors
+func TestErrorCode(t *testing.T) {
+	syntaxErr := json.Unmarshal([]byte("{"), &Record{})
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{&CheckError{Service: ServiceReqMgr, Err: fmt.Errorf("wf: %w", ErrWorkflowNotFound)}, "reqmgr_not_found"},
+		{&CheckError{Service: ServiceReqMgr, Err: &HTTPError{StatusCode: http.StatusNotFound}}, "reqmgr_not_found"},
+		{&CheckError{Service: ServiceDBS, Err: context.DeadlineExceeded}, "dbs_timeout"},
+		{&CheckError{Service: ServiceDBS, Err: &HTTPError{StatusCode: http.StatusBadGateway}}, "dbs_http_5xx"},
+		{&CheckError{Service: ServiceDBS, Err: &HTTPError{StatusCode: http.StatusForbidden}}, "dbs_http_4xx"},
+		{&CheckError{Service: ServiceDBS, Err: ErrCircuitOpen}, "dbs_unavailable"},
+		{&CheckError{Service: ServiceDBS, Err: ErrDatasetNotFound}, "dbs_not_found"},
+		{&CheckError{Service: ServiceReqMgr, Err: syntaxErr}, "parse_error"},
+		{context.Canceled, "cancelled"},
+		{errors.New("unknown"), "internal_error"},
+	}
+	for _, tt := range tests {
+		if code := errorCode(tt.err); code != tt.code {
+			t.Errorf("wrong error code %s of %v, expect %s", code, tt.err, tt.code)
+		}
+	}
+}
+
+// stubSource implements WorkflowSource and DatasetStatsSource interfaces
+// for workflows with single output dataset of input dataset /A/B/RAW and
+// pileup dataset /MinBias/PU/GEN-SIM, the workflow "bad" is not found
+type stubSource struct {
+	maxDelay   time.Duration      // max random delay of workflow calls
+	pileupErr  error              // error of pileup calls
+	lineageErr error              // error of lineage calls
+	cancel     context.CancelFunc // function called by lineage calls
+	pileups    *int32             // number of pileup calls
+}
+
+// Workflow implements WorkflowSource interface
+func (s stubSource) Workflow(ctx context.Context, name string) (*ReqMgrRecord, error) {
+	if s.maxDelay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(s.maxDelay))))
+	}
+	if name == "bad" {
+		return nil, fmt.Errorf("%s: %w", name, ErrWorkflowNotFound)
+	}
+	rec := &ReqMgrRecord{
+		InputDataset:   "/A/B/RAW",
+		OutputDatasets: []string{fmt.Sprintf("/A/%s/AOD", name)},
+		MCPileup:       "/MinBias/PU/GEN-SIM",
+	}
+	return rec, nil
+}
+
+// DatasetStats implements DatasetStatsSource interface
+func (s stubSource) DatasetStats(ctx context.Context, dataset string) (*DBSRecord, error) {
+	return &DBSRecord{NumLumis: 10, NumEvents: 100, AccessType: "VALID"}, nil
+}
+
+// PileupStats implements DatasetStatsSource interface
+func (s stubSource) PileupStats(ctx context.Context, dataset string) (*PileupRecord, error) {
+	if s.pileups != nil {
+		atomic.AddInt32(s.pileups, 1)
+	}
+	if s.pileupErr != nil {
+		return nil, s.pileupErr
+	}
+	return &PileupRecord{Dataset: dataset, AccessType: "VALID"}, nil
+}
+
+// DatasetLineage implements DatasetStatsSource interface
+func (s stubSource) DatasetLineage(ctx context.Context, dataset, parent string, blocks []string) (*Lineage, error) {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.lineageErr != nil {
+		return nil, s.lineageErr
+	}
+	return &Lineage{ParentDataset: parent, ParentDatasets: []string{parent}}, nil
+}
+
+// TestConcurrentCheckOrder tests that records are returned in workflows
+// order when workers finish their workflows out of order
+func TestConcurrentCheckOrder(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+	Config.MaxWorkflows = 8
+	var wflows []string
+	for i := 0; i < 40; i++ {
+		wflows = append(wflows, fmt.Sprintf("wf%d", i))
+	}
+	wflows = append(wflows[:20], append([]string{"bad"}, wflows[20:]...)...)
+	src := stubSource{maxDelay: 5 * time.Millisecond}
+	out, err := concurrentCheck(context.Background(), wflows, src, src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(wflows) {
+		t.Fatalf("wrong number of records %d, expect %d", len(out), len(wflows))
+	}
+	for i, r := range out {
+		if r.Workflow != wflows[i] {
+			t.Fatalf("record #%d of %s, expect %s", i, r.Workflow, wflows[i])
+		}
+		if r.Workflow == "bad" {
+			if r.ErrorCode != ErrCodeReqMgrNotFound {
+				t.Errorf("wrong error record %+v", r)
+			}
+			continue
+		}
+		if r.Status != StatusOK || r.OutputDataset != fmt.Sprintf("/A/%s/AOD", r.Workflow) {
+			t.Errorf("unexpected record %+v", r)
+		}
+	}
+}
+
+// TestCheckLineageError tests that workflow whose lineage can not be
+// checked is reported by error and not by OK record
+func TestCheckLineageError(t *testing.T) {
+	src := stubSource{}
+	out, err := check(context.Background(), "wf", src, src, false)
+	if err != nil || len(out) != 1 || out[0].Status != StatusOK {
+		t.Fatalf("unexpected records %+v, error %v", out, err)
+	}
+	src.lineageErr = &HTTPError{StatusCode: http.StatusBadGateway}
+	_, err = check(context.Background(), "wf", src, src, false)
+	if code := errorCode(err); code != "dbs_http_5xx" {
+		t.Errorf("wrong error code %s of %v", code, err)
+	}
+	src.lineageErr = &BlocksError{Blocks: []string{"/A/wf/AOD#1"}, Errors: []error{errors.New("fail")}}
+	out, err = check(context.Background(), "wf", src, src, false)
+	if err != nil || len(out) != 1 || out[0].Status != StatusError || len(out[0].FailedBlocks) != 1 {
+		t.Errorf("unexpected records %+v, error %v", out, err)
+	}
+	// workflow cancelled while its lineage is checked
+	ctx, cancel := context.WithCancel(context.Background())
+	src.lineageErr = nil
+	src.cancel = cancel
+	_, err = check(ctx, "wf", src, src, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expect cancellation error, got %v", err)
+	}
+}
+
+// TestCheckPileupError tests that pileup dataset we fail to fetch is
+// reported as failed while output dataset is still checked
+func TestCheckPileupError(t *testing.T) {
+	src := stubSource{pileupErr: &HTTPError{StatusCode: http.StatusBadGateway}}
+	out, err := check(context.Background(), "wf", src, src, false)
+	if err != nil || len(out) != 1 {
+		t.Fatalf("unexpected records %+v, error %v", out, err)
+	}
+	rec := out[0]
+	if rec.Status != StatusError || len(rec.PileupStats) != 1 || !rec.PileupStats[0].Failed {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if rec.OutputStats.Lineage == nil {
+		t.Errorf("output dataset is not checked")
+	}
+}
+
+// TestConcurrentCheckPileupCache tests that pileup dataset shared by
+// workflows is fetched once while failed calls are not cached
+func TestConcurrentCheckPileupCache(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+	Config.MaxWorkflows = 8
+	var wflows []string
+	for i := 0; i < 40; i++ {
+		wflows = append(wflows, fmt.Sprintf("wf%d", i))
+	}
+	var calls int32
+	src := stubSource{maxDelay: time.Millisecond, pileups: &calls}
+	out, err := concurrentCheck(context.Background(), wflows, src, src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("wrong number of pileup calls %d", calls)
+	}
+	for _, r := range out {
+		if len(r.PileupStats) != 1 || r.PileupStats[0].Type != "MCPileup" || r.PileupStats[0].Failed {
+			t.Errorf("wrong pileup stats of %s %+v", r.Workflow, r.PileupStats)
+		}
+	}
+
+	calls = 0
+	src.pileupErr = &HTTPError{StatusCode: http.StatusBadGateway}
+	out, err = concurrentCheck(context.Background(), wflows, src, src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(calls) != len(wflows) {
+		t.Errorf("wrong number of failed pileup calls %d", calls)
+	}
+	for _, r := range out {
+		if len(r.PileupStats) != 1 || !r.PileupStats[0].Failed {
+			t.Errorf("wrong pileup stats of %s %+v", r.Workflow, r.PileupStats)
+		}
+	}
+}
+
+// mcSource implements WorkflowSource and DatasetStatsSource interfaces for
+// MonteCarlo from scratch workflow with 1000 requested events, 100 events
+// per lumi and 0.5 filter efficiency
+type mcSource struct {
+	stats DBSRecord // output dataset statistics
+}
+
+// Workflow implements WorkflowSource interface
+func (s mcSource) Workflow(ctx context.Context, name string) (*ReqMgrRecord, error) {
+	rec := &ReqMgrRecord{
+		RequestType:      "MonteCarlo",
+		OutputDatasets:   []string{"/A/MC-v1/AODSIM"},
+		RequestNumEvents: 1000,
+		EventsPerLumi:    100,
+		FilterEfficiency: 0.5,
+	}
+	return rec, nil
+}
+
+// DatasetStats implements DatasetStatsSource interface
+func (s mcSource) DatasetStats(ctx context.Context, dataset string) (*DBSRecord, error) {
+	stats := s.stats
+	return &stats, nil
+}
+
+// PileupStats implements DatasetStatsSource interface
+func (s mcSource) PileupStats(ctx context.Context, dataset string) (*PileupRecord, error) {
+	return &PileupRecord{}, nil
+}
+
+// DatasetLineage implements DatasetStatsSource interface
+func (s mcSource) DatasetLineage(ctx context.Context, dataset, parent string, blocks []string) (*Lineage, error) {
+	return nil, errors.New("lineage of MonteCarlo from scratch output")
+}
+
+// TestCheckFromScratch tests that output of MonteCarlo from scratch workflow
+// is compared with requested number of lumis and events
+func TestCheckFromScratch(t *testing.T) {
+	tests := []struct {
+		name       string
+		lumis      int64
+		events     int64
+		status     string
+		completion float64
+		severities map[string]string
+	}{
+		{"complete", 10, 500, StatusOK, 100, map[string]string{"mc_num_lumi": StatusOK, "mc_completion": StatusOK}},
+		{"enough events", 10, 480, StatusOK, 96, map[string]string{"mc_num_lumi": StatusOK, "mc_completion": StatusOK}},
+		{"missing lumis", 9, 500, StatusWarning, 100, map[string]string{"mc_num_lumi": StatusWarning, "mc_completion": StatusOK}},
+		{"missing events", 10, 400, StatusWarning, 80, map[string]string{"mc_num_lumi": StatusOK, "mc_completion": StatusWarning}},
+	}
+	for _, tt := range tests {
+		src := mcSource{stats: DBSRecord{NumLumis: tt.lumis, NumEvents: tt.events, AccessType: "VALID"}}
+		out, err := check(context.Background(), "wf", src, src, false)
+		if err != nil || len(out) != 1 {
+			t.Fatalf("%s: unexpected records %+v, error %v", tt.name, out, err)
+		}
+		rec := out[0]
+		expect := ExpectedStats{NumLumis: 10, NumEvents: 500, FromScratch: true}
+		if rec.ExpectedStats == nil || *rec.ExpectedStats != expect {
+			t.Errorf("%s: wrong expected stats %+v", tt.name, rec.ExpectedStats)
+		}
+		if rec.InputDataset != "" || rec.RequestNumEvents != 1000 || rec.Completion != tt.completion || rec.Status != tt.status {
+			t.Errorf("%s: unexpected record %+v", tt.name, rec)
+		}
+		severities := make(map[string]string)
+		for _, r := range rec.Checks {
+			severities[r.Rule] = r.Severity
+		}
+		for rule, severity := range tt.severities {
+			if severities[rule] != severity {
+				t.Errorf("%s: wrong severity %q of %s rule, expect %q", tt.name, severities[rule], rule, severity)
+			}
+		}
+		// rules of input dataset are not evaluated
+		for _, rule := range []string{"num_lumi", "num_event", "total_input_lumis", "lineage_parent_dataset"} {
+			if _, ok := severities[rule]; ok {
+				t.Errorf("%s: unexpected %s rule of MonteCarlo from scratch output", tt.name, rule)
+			}
+		}
+	}
+}
+
+// TestFileSourceCheck tests workflow check against fixtures directory
+func TestFileSourceCheck(t *testing.T) {
+	testPool()
+	src := &FileSource{Dir: "testdata/fixtures"}
+	out, err := concurrentCheck(context.Background(), []string{"wf1", "wf2", "bad"}, src, src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 3 {
+		t.Fatalf("wrong number of records %d", len(out))
+	}
+	for _, r := range out[:2] {
+		if r.Status != StatusWarning || r.Error != "" {
+			t.Errorf("unexpected record %+v", r)
+		}
+		if r.InputStats.NumLumis != 3 || r.OutputStats.NumLumis != 2 {
+			t.Errorf("wrong number of lumis in %s, input %d output %d", r.Workflow, r.InputStats.NumLumis, r.OutputStats.NumLumis)
+		}
+		if r.LumiDiff == nil || r.LumiDiff.NumMissing != 1 {
+			t.Errorf("wrong lumi diff in %s %+v", r.Workflow, r.LumiDiff)
+		}
+	}
+	if len(out[0].PileupStats) != 0 || len(out[1].PileupStats) != 1 {
+		t.Errorf("wrong pileup stats %+v %+v", out[0].PileupStats, out[1].PileupStats)
+	}
+	if out[2].Status != StatusError || out[2].ErrorCode != ErrCodeReqMgrNotFound {
+		t.Errorf("unexpected record %+v", out[2])
+	}
+
+	// workflow name can not point outside of fixtures directory
+	for _, name := range []string{"../fixtures/reqmgr/wf1", "..", "reqmgr/wf1", `..\wf1`} {
+		if _, err := src.Workflow(context.Background(), name); !errors.Is(err, ErrWorkflowNotFound) {
+			t.Errorf("expect not found error for %s, got %v", name, err)
+		}
+	}
+}
+
+// TestFixturesDBSInstance tests that DBS instance can not be changed in
+// offline mode
+func TestFixturesDBSInstance(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+	Config.Fixtures = "testdata/fixtures"
+	req := httptest.NewRequest("GET", "/stats?workflow=wf1&dbs_instance=prod/phys03", nil)
+	w := httptest.NewRecorder()
+	DataHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code %d, expect %d", w.Code, http.StatusBadRequest)
+	}
+}
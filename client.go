@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vkuznet/x509proxy"
+)
+
+// default number of idle (keep-alive) connections per host, it matches
+// default number of pool workers which call DBS concurrently
+const defaultMaxIdleConnsPerHost = 100
+
+// default location of CA certificates of grid services
+const defaultCADir = "/etc/grid-security/certificates"
+
+// interval to check if X509 credentials were changed on disk
+const credentialsCheckInterval = 30 * time.Second
+
+// ClientManager manages HTTP transport shared by all upstream calls, this
+// way connections (and TLS sessions) are reused across requests. The X509
+// credentials are loaded once and reloaded when credentials file is changed.
+type ClientManager struct {
+	once      sync.Once
+	transport *http.Transport
+	offline   bool // do not load credentials in offline mode
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate // client certificate, empty if user has no credentials
+	credFile  string           // proxy or certificate file the certificate was loaded from
+	modTime   time.Time        // modification time of credentials file
+	lastCheck time.Time        // last time credentials file was checked
+}
+
+// clientManager represents HTTP client manager used by the service
+var clientManager = &ClientManager{}
+
+// helper function to find X509 credentials files, it returns either proxy
+// file or user certificate and key files
+func x509Files() (string, string, string) {
+	uproxy := os.Getenv("X509_USER_PROXY")
+	uckey := os.Getenv("X509_USER_KEY")
+	ucert := os.Getenv("X509_USER_CERT")
+
+	// check if /tmp/x509up_u$UID exists, if so setup X509_USER_PROXY env
+	u, err := user.Current()
+	if err == nil {
+		fname := fmt.Sprintf("/tmp/x509up_u%s", u.Uid)
+		if _, err := os.Stat(fname); err == nil {
+			uproxy = fname
+		}
+	}
+	return uproxy, ucert, uckey
+}
+
+// client X509 certificate along with file it was loaded from
+func tlsCert() (*tls.Certificate, string, error) {
+	uproxy, ucert, uckey := x509Files()
+	if uproxy == "" && uckey == "" { // user doesn't have neither proxy or user certs
+		return &tls.Certificate{}, "", nil
+	}
+	if uproxy != "" {
+		// use local implementation of LoadX409KeyPair instead of tls one
+		x509cert, err := x509proxy.LoadX509Proxy(uproxy)
+		if err != nil {
+			return nil, uproxy, fmt.Errorf("failed to parse X509 proxy: %v", err)
+		}
+		return &x509cert, uproxy, nil
+	}
+	x509cert, err := tls.LoadX509KeyPair(ucert, uckey)
+	if err != nil {
+		return nil, ucert, fmt.Errorf("failed to parse user X509 certificate: %v", err)
+	}
+	return &x509cert, ucert, nil
+}
+
+// helper function to get modification time of given file
+func modTime(fname string) time.Time {
+	if fname == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(fname)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Transport returns shared HTTP transport, it is created on first call
+// using pool settings of server configuration
+func (m *ClientManager) Transport(verbose bool) *http.Transport {
+	m.once.Do(func() {
+		// in offline (fixtures or replay) mode upstream services are not
+		// called, therefore we neither need X509 credentials nor CA
+		// certificates
+		m.offline = Config.Fixtures != "" || Config.Replay != ""
+		var rootCAs *x509.CertPool
+		if m.offline {
+			m.cert = &tls.Certificate{}
+		} else {
+			if err := m.loadCredentials(verbose); err != nil {
+				log.Fatal(err)
+			}
+			pool, err := caCertPool(caPath(), verbose)
+			if err != nil {
+				log.Fatal(err)
+			}
+			rootCAs = pool
+			if Config.Insecure {
+				log.Println("WARNING: TLS verification of upstream services is disabled")
+			}
+		}
+		maxIdle := Config.MaxIdleConnsPerHost
+		if maxIdle <= 0 {
+			maxIdle = defaultMaxIdleConnsPerHost
+		}
+		m.transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				GetClientCertificate: m.clientCertificate,
+				RootCAs:              rootCAs,
+				InsecureSkipVerify:   Config.Insecure,
+			},
+			ForceAttemptHTTP2:   !Config.DisableHTTP2,
+			MaxIdleConns:        Config.MaxIdleConns,
+			MaxIdleConnsPerHost: maxIdle,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+		m.transport.RegisterProtocol("file", fileTransport{})
+	})
+	m.refresh(verbose)
+	return m.transport
+}
+
+// helper function to load X509 credentials
+func (m *ClientManager) loadCredentials(verbose bool) error {
+	cert, fname, err := tlsCert()
+	if err != nil {
+		return err
+	}
+	if verbose && fname != "" {
+		log.Println("load X509 credentials from", fname)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cert = cert
+	m.credFile = fname
+	m.modTime = modTime(fname)
+	m.lastCheck = time.Now()
+	return nil
+}
+
+// helper function to reload X509 credentials if credentials file was
+// changed on disk, the idle connections established with old credentials
+// are closed
+func (m *ClientManager) refresh(verbose bool) {
+	if m.offline {
+		return
+	}
+	m.mu.RLock()
+	check := time.Since(m.lastCheck) > credentialsCheckInterval
+	credFile, mtime := m.credFile, m.modTime
+	m.mu.RUnlock()
+	if !check {
+		return
+	}
+	uproxy, ucert, _ := x509Files()
+	fname := uproxy
+	if fname == "" {
+		fname = ucert
+	}
+	if fname == credFile && modTime(fname).Equal(mtime) {
+		m.mu.Lock()
+		m.lastCheck = time.Now()
+		m.mu.Unlock()
+		return
+	}
+	if err := m.loadCredentials(verbose); err != nil {
+		// keep using old credentials, we'll try again later
+		log.Println("ERROR: unable to reload X509 credentials", err)
+		m.mu.Lock()
+		m.lastCheck = time.Now()
+		m.mu.Unlock()
+		return
+	}
+	m.transport.CloseIdleConnections()
+}
+
+// helper function to provide client certificate during TLS handshake
+func (m *ClientManager) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert, nil
+}
+
+// helper function to get location of CA certificates, it is taken (in order
+// of precedence) from server configuration, X509_CERT_DIR environment
+// variable or default grid CA directory if it exists
+func caPath() string {
+	if Config.CAPath != "" {
+		return Config.CAPath
+	}
+	if dir := os.Getenv("X509_CERT_DIR"); dir != "" {
+		return dir
+	}
+	if _, err := os.Stat(defaultCADir); err == nil {
+		return defaultCADir
+	}
+	return ""
+}
+
+// helper function to construct pool of CA certificates from system pool and
+// given CA directory or bundle file
+func caCertPool(path string, verbose bool) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if path == "" {
+		return pool, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA certificates: %w", err)
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificates: %w", err)
+		}
+		files = nil
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	count := 0
+	for _, fname := range files {
+		data, err := os.ReadFile(filepath.Clean(fname))
+		if err != nil {
+			continue
+		}
+		// CA directory contains other files as well, e.g. signing policies,
+		// which are skipped since they do not contain PEM certificates
+		if pool.AppendCertsFromPEM(data) {
+			count++
+		}
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no CA certificates found in %s", path)
+	}
+	if verbose {
+		log.Printf("load CA certificates from %d file(s) of %s", count, path)
+	}
+	return pool, nil
+}
+
+// tlsErrorTransport implements http.RoundTripper interface and explains
+// TLS verification errors of underlying transport
+type tlsErrorTransport struct {
+	Transport http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t tlsErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, tlsError(req.URL.Host, err)
+	}
+	return resp, nil
+}
+
+// TLSVerificationError represents failure to verify TLS certificate of
+// upstream service
+type TLSVerificationError struct {
+	Host string // upstream host
+	Err  error  // verification error
+}
+
+// Error implements error interface
+func (e *TLSVerificationError) Error() string {
+	return fmt.Sprintf("unable to verify TLS certificate of %s, provide CA certificates via -caPath flag (caPath configuration) or X509_CERT_DIR environment variable, or use -insecure flag to skip verification: %v", e.Host, e.Err)
+}
+
+// Unwrap returns underlying verification error
+func (e *TLSVerificationError) Unwrap() error {
+	return e.Err
+}
+
+// helper function to provide clear message for TLS verification errors
+func tlsError(host string, err error) error {
+	var uerr x509.UnknownAuthorityError
+	var herr x509.HostnameError
+	var cerr x509.CertificateInvalidError
+	if errors.As(err, &uerr) || errors.As(err, &herr) || errors.As(err, &cerr) {
+		return &TLSVerificationError{Host: host, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOfflineTransport tests that shared transport of offline mode does not
+// require X509 credentials
+func TestOfflineTransport(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+	fname := filepath.Join(t.TempDir(), "x509up")
+	if err := os.WriteFile(fname, []byte("stale proxy"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("X509_USER_PROXY", fname)
+	t.Setenv("X509_CERT_DIR", t.TempDir())
+	for _, mode := range []string{"fixtures", "replay"} {
+		Config.Fixtures, Config.Replay = "", ""
+		if mode == "fixtures" {
+			Config.Fixtures = "testdata/fixtures"
+		} else {
+			Config.Replay = t.TempDir()
+		}
+		m := &ClientManager{}
+		if tr := m.Transport(false); tr == nil {
+			t.Errorf("%s: no transport", mode)
+		}
+		if m.credFile != "" {
+			t.Errorf("%s: credentials are loaded from %s", mode, m.credFile)
+		}
+	}
+}
+
+// helper function to generate self-signed certificate and its key in PEM
+// format for given common name
+func testCertificate(t *testing.T, cn string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+}
+
+// helper function to write file with given modification time
+func writeFile(t *testing.T, fname string, data []byte, mtime time.Time) {
+	if err := os.WriteFile(fname, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCredentialsRefresh tests that X509 credentials are reloaded when
+// credentials file is changed and kept when new file can not be loaded
+func TestCredentialsRefresh(t *testing.T) {
+	if u, err := user.Current(); err == nil {
+		if _, err := os.Stat(fmt.Sprintf("/tmp/x509up_u%s", u.Uid)); err == nil {
+			t.Skip("user proxy takes precedence over test credentials")
+		}
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "usercert.pem")
+	keyFile := filepath.Join(dir, "userkey.pem")
+	t.Setenv("X509_USER_PROXY", "")
+	t.Setenv("X509_USER_CERT", certFile)
+	t.Setenv("X509_USER_KEY", keyFile)
+	mtime := time.Now().Add(-time.Hour)
+	cert1, key1 := testCertificate(t, "user1")
+	writeFile(t, certFile, cert1, mtime)
+	writeFile(t, keyFile, key1, mtime)
+
+	m := &ClientManager{transport: &http.Transport{}}
+	if err := m.loadCredentials(false); err != nil {
+		t.Fatal(err)
+	}
+	first := m.cert.Certificate[0]
+	if m.credFile != certFile {
+		t.Errorf("wrong credentials file %s", m.credFile)
+	}
+
+	// credentials file is not checked within check interval
+	cert2, key2 := testCertificate(t, "user2")
+	writeFile(t, certFile, cert2, mtime.Add(time.Minute))
+	writeFile(t, keyFile, key2, mtime.Add(time.Minute))
+	m.refresh(false)
+	if !bytes.Equal(m.cert.Certificate[0], first) {
+		t.Error("credentials are reloaded within check interval")
+	}
+
+	// changed credentials file is reloaded after check interval
+	m.lastCheck = time.Now().Add(-2 * credentialsCheckInterval)
+	m.refresh(false)
+	second := m.cert.Certificate[0]
+	if bytes.Equal(second, first) {
+		t.Error("changed credentials are not reloaded")
+	}
+
+	// broken credentials file does not replace loaded credentials
+	writeFile(t, certFile, []byte("broken"), mtime.Add(2*time.Minute))
+	m.lastCheck = time.Now().Add(-2 * credentialsCheckInterval)
+	m.refresh(false)
+	if !bytes.Equal(m.cert.Certificate[0], second) {
+		t.Error("credentials are replaced by broken ones")
+	}
+	if time.Since(m.lastCheck) > time.Minute {
+		t.Error("last check time is not updated")
+	}
+}
+
+// TestCACertPool tests loading of CA certificates from directory and bundle
+// file
+func TestCACertPool(t *testing.T) {
+	dir := t.TempDir()
+	ca1, _ := testCertificate(t, "CA1")
+	ca2, _ := testCertificate(t, "CA2")
+	writeFile(t, filepath.Join(dir, "ca1.pem"), ca1, time.Now())
+	writeFile(t, filepath.Join(dir, "ca2.pem"), ca2, time.Now())
+	// CA directory contains other files which are skipped
+	writeFile(t, filepath.Join(dir, "ca1.signing_policy"), []byte("access_id_CA X509 '/CN=CA1'"), time.Now())
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "bundle.pem")
+	writeFile(t, bundle, append(ca1, ca2...), time.Now())
+	for _, path := range []string{dir, bundle} {
+		pool, err := caCertPool(path, false)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if pool == nil {
+			t.Errorf("%s: no CA pool", path)
+		}
+	}
+
+	empty := t.TempDir()
+	writeFile(t, filepath.Join(empty, "ca.signing_policy"), []byte("policy"), time.Now())
+	if _, err := caCertPool(empty, false); err == nil || !strings.Contains(err.Error(), "no CA certificates found") {
+		t.Errorf("expect no CA certificates error, got %v", err)
+	}
+	if _, err := caCertPool(filepath.Join(empty, "missing"), false); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expect not exist error, got %v", err)
+	}
+	if pool, err := caCertPool("", false); err != nil || pool == nil {
+		t.Errorf("unexpected system pool %v, error %v", pool, err)
+	}
+}
+
+// TestTLSError tests that TLS verification errors of upstream calls are
+// explained by TLSVerificationError while other errors are kept as is
+func TestTLSError(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	writeFile(t, filepath.Join(dir, "ca.pem"), ca, time.Now())
+	rootCAs, err := caCertPool(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		config   *tls.Config
+		verified bool
+	}{
+		{"trusted CA", &tls.Config{RootCAs: rootCAs}, true},
+		{"unknown authority", &tls.Config{RootCAs: x509.NewCertPool()}, false},
+		{"wrong host name", &tls.Config{RootCAs: rootCAs, ServerName: "cmsweb.cern.ch"}, false},
+		{"insecure", &tls.Config{RootCAs: x509.NewCertPool(), InsecureSkipVerify: true}, true},
+	}
+	for _, tt := range tests {
+		tr := &http.Transport{TLSClientConfig: tt.config}
+		client := &http.Client{Transport: tlsErrorTransport{Transport: tr}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		tr.CloseIdleConnections()
+		var verr *TLSVerificationError
+		if tt.verified && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if !tt.verified && !errors.As(err, &verr) {
+			t.Errorf("%s: expect TLS verification error, got %v", tt.name, err)
+		}
+		if !tt.verified && retryableError(err) {
+			t.Errorf("%s: TLS verification error is retryable", tt.name)
+		}
+	}
+	if err := tlsError("cmsweb.cern.ch", io.EOF); err != io.EOF {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -1,114 +1,190 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 )
 
-const dbsUrl string = "https://cmsweb.cern.ch/dbs/prod/global/DBSReader"
+// default DBS url
+const defaultDBSUrl string = "https://cmsweb.cern.ch/dbs/prod/global/DBSReader"
+
+// dbsInstancePattern represents DBS instance pattern, e.g. prod/phys03
+var dbsInstancePattern = regexp.MustCompile("^[a-z]+/[a-z0-9]+$")
+
+// helper function to construct DBS url for given DBS instance, e.g. prod/phys03
+func dbsInstanceUrl(rurl, instance string) (string, error) {
+	if !dbsInstancePattern.MatchString(instance) {
+		return "", fmt.Errorf("invalid DBS instance '%s'", instance)
+	}
+	idx := strings.Index(rurl, "/dbs/")
+	if idx == -1 {
+		return "", fmt.Errorf("unable to apply DBS instance '%s' to %s", instance, rurl)
+	}
+	return fmt.Sprintf("%s/dbs/%s/DBSReader", rurl[:idx], instance), nil
+}
 
 // helper function to get DBS stats for total/valid number of files
-func dbsStats(dataset string, verbose bool) (*DBSRecord, error) {
-	rec, err := dbsDatasetStats(dataset, 1, verbose)
+// If some of dataset blocks can not be fetched from DBS the function returns
+// DBS record along with BlocksError listing failed blocks. The record
+// includes per-block statistics and invalid files report if requested.
+func dbsStats(ctx context.Context, dbsUrl, dataset string, details Details, verbose bool) (*DBSRecord, error) {
+	rec, err := dbsDatasetStats(ctx, dbsUrl, dataset, 1, verbose)
 	if err != nil {
-		fmt.Printf("ERROR: unable to call dbsDatasetStats for %s, %v", dataset, err)
+		log.Printf("ERROR: unable to call dbsDatasetStats for %s, %v", dataset, err)
 		return rec, err
 	}
-	blocks, err := dbsBlocks(dataset, verbose)
+	info, err := dbsDatasetInfo(ctx, dbsUrl, dataset, verbose)
 	if err != nil {
-		fmt.Printf("ERROR: unable to call dbsBlocks for %s, %v", dataset, err)
+		log.Printf("ERROR: unable to call dbsDatasetInfo for %s, %v", dataset, err)
 		return rec, err
 	}
-	totalLumis, uniqueLumis, err := dbsBlocksLumis(blocks, verbose)
+	rec.AccessType = info.AccessType
+	rec.PhysicsGroup = info.PhysicsGroup
+	rec.CreationDate = info.CreationDate
+	rec.LastModificationDate = info.LastModificationDate
+	rec.ProcessingVersion = info.ProcessingVersion
+	blockRecords, err := dbsBlocks(ctx, dbsUrl, dataset, details.Blocks, verbose)
 	if err != nil {
-		fmt.Printf("ERROR: unable to call dbsBlocksLumis for %s, %v", dataset, err)
+		log.Printf("ERROR: unable to call dbsBlocks for %s, %v", dataset, err)
 		return rec, err
 	}
+	var blocks []string
+	for _, b := range blockRecords {
+		blocks = append(blocks, b.BlockName)
+	}
+	berr := &BlocksError{}
+	blockLumis, err := dbsBlocksLumis(ctx, dbsUrl, blocks, verbose)
+	if err != nil {
+		log.Printf("ERROR: unable to call dbsBlocksLumis for %s, %v", dataset, err)
+		if !errors.As(err, &berr) {
+			return rec, err
+		}
+	}
+	// lumis of invalid files are not part of dataset, i.e. lumis present
+	// only in invalid files are lost and lumis reprocessed into new valid
+	// files are not duplicated
+	validLumis := validRunLumis(blockLumis, rec.invalidFiles)
+	totalLumis, lumis, candidates := uniqueRunLumis(validLumis)
 	rec.TotalFileLumis = totalLumis
-	rec.UniqueFileLumis = uniqueLumis
+	rec.UniqueFileLumis = int64(lumis.Len())
+	rec.lostLumis = lostLumis(blockLumis, rec.invalidFiles)
+	rec.NumLostLumis = int64(rec.lostLumis.Len())
+	rec.NumRuns = int64(len(lumis.Runs()))
+	rec.LumiMask = lumis.Mask()
+	rec.lumis = lumis
+	// run/lumi pairs which appear more than once are duplicated only if
+	// they are present in more than one file
+	rec.dupLumis, rec.DuplicatedLumis, rec.NumDuplicatedEvents = duplicatedLumis(validLumis, candidates)
+	rec.NumDuplicatedLumis = int64(rec.dupLumis.Len())
 
-	totalLumis, err = dbsFilesummariesLumis(blocks, verbose)
+	summaries, err := dbsFilesummariesLumis(ctx, dbsUrl, blocks, verbose)
 	if err != nil {
-		fmt.Printf("ERROR: unable to call dbsFilesummariesLumis for %s, %v", dataset, err)
-		return rec, err
+		log.Printf("ERROR: unable to call dbsFilesummariesLumis for %s, %v", dataset, err)
+		var e *BlocksError
+		if !errors.As(err, &e) {
+			return rec, err
+		}
+		berr.Add(e)
+	}
+	for _, r := range summaries {
+		rec.FilesummariesLumis += r.NumLumi
+	}
+	rec.blockNames = blocks
+	rec.blockLumis = blockLumis
+	rec.blockSummaries = summaries
+	if details.Blocks {
+		rec.Blocks = blockStats(rec, blockRecords, berr.Blocks)
+	}
+	if details.InvalidFiles && len(rec.invalidFiles) > 0 {
+		rec.InvalidFiles = invalidFiles(rec.invalidFiles, blockLumis, rec.lostLumis)
+	}
+	if len(berr.Blocks) != 0 {
+		return rec, berr
 	}
-	rec.FilesummariesLumis = totalLumis
 	return rec, nil
 }
 
 // DBSRecord represents filesummaries record we need to parse
 type DBSRecord struct {
-	NumLumis           int64 `json:"num_lumi"`            // output of filesummaries?dataset=xxx
-	NumFiles           int64 `json:"num_file"`            // output of filesummaries?dataset=xxx
-	NumEvents          int64 `json:"num_event"`           // output of filesummaries?dataset=xxx
-	NumBlocks          int64 `json:"num_block"`           // output of filesummaries?dataset=xxx
-	TotalFileLumis     int64 `json:"num_file_lumis"`      // output of filelumis?block_name=xxx
-	UniqueFileLumis    int64 `json:"unique_file_lumis"`   // output of filelumis?block_name=xxx
-	FilesummariesLumis int64 `json:"filesummaries_lumis"` // output of filesummaries?block_name=xxx
-	NumInvalidFiles    int64 `json:"num_invalid_files"`   // number of invalid files
+	NumLumis             int64            `json:"num_lumi"`                         // output of filesummaries?dataset=xxx
+	NumFiles             int64            `json:"num_file"`                         // output of filesummaries?dataset=xxx
+	NumEvents            int64            `json:"num_event"`                        // output of filesummaries?dataset=xxx
+	NumBlocks            int64            `json:"num_block"`                        // output of filesummaries?dataset=xxx
+	TotalFileLumis       int64            `json:"num_file_lumis"`                   // output of filelumis?block_name=xxx of valid files
+	UniqueFileLumis      int64            `json:"unique_file_lumis"`                // output of filelumis?block_name=xxx of valid files
+	FilesummariesLumis   int64            `json:"filesummaries_lumis"`              // output of filesummaries?block_name=xxx
+	NumInvalidFiles      int64            `json:"num_invalid_files"`                // number of invalid files
+	NumRuns              int64            `json:"num_runs"`                         // number of runs, output of filelumis?block_name=xxx
+	LumiMask             LumiMask         `json:"lumi_mask,omitempty"`              // run/lumi ranges, output of filelumis?block_name=xxx
+	Lineage              *Lineage         `json:"lineage,omitempty"`                // parentage of dataset files
+	AccessType           string           `json:"dataset_access_type"`              // output of datasets?dataset=xxx
+	PhysicsGroup         string           `json:"physics_group_name,omitempty"`     // output of datasets?dataset=xxx
+	CreationDate         int64            `json:"creation_date,omitempty"`          // output of datasets?dataset=xxx
+	LastModificationDate int64            `json:"last_modification_date,omitempty"` // output of datasets?dataset=xxx
+	ProcessingVersion    int              `json:"processing_version,omitempty"`     // output of datasets?dataset=xxx
+	Blocks               []BlockStats     `json:"blocks,omitempty"`                 // per-block statistics, output of blocks?dataset=xxx&detail=1
+	NumDuplicatedLumis   int64            `json:"num_duplicated_lumis"`             // number of run/lumi pairs present in more than one file
+	NumDuplicatedEvents  int64            `json:"num_duplicated_events"`            // number of events of duplicated run/lumi pairs in extra files
+	DuplicatedLumis      []DuplicatedLumi `json:"duplicated_lumis,omitempty"`       // run/lumi pairs present in more than one file
+	NumLostLumis         int64            `json:"num_lost_lumis"`                   // number of run/lumi pairs present only in invalid files
+	InvalidFiles         []InvalidFile    `json:"invalid_files,omitempty"`          // invalid files report
+
+	lumis          RunLumiSet  // set of run/lumi pairs of the dataset
+	dupLumis       RunLumiSet  // set of run/lumi pairs present in more than one file
+	blockNames     []string    // names of dataset blocks
+	blockLumis     [][]RunLumi // run/lumi records of dataset blocks
+	blockSummaries []Lumi      // filesummaries of dataset blocks
+	invalidFiles   []DBSFile   // invalid files of the dataset
+	lostLumis      RunLumiSet  // set of run/lumi pairs present only in invalid files
 }
 
 // DBSBlocks represents blocks record we need to parse
 type DBSBlock struct {
-	BlockName string `json:"block_name"`
+	BlockName      string `json:"block_name"`
+	OpenForWriting int    `json:"open_for_writing"`
+	OriginSite     string `json:"origin_site_name"`
 }
 
-// helper function to get list of blocks for a given dataset
-func dbsBlocks(dataset string, verbose bool) ([]string, error) {
-	var blocks []string
+// helper function to get list of blocks for a given dataset, the blocks
+// details (e.g. origin site) are requested only if detail flag is set
+func dbsBlocks(ctx context.Context, dbsUrl, dataset string, detail, verbose bool) ([]DBSBlock, error) {
+	var blocks []DBSBlock
 	rurl := fmt.Sprintf("%s/blocks?dataset=%s", dbsUrl, dataset)
-	if verbose {
-		log.Println("dbs call", rurl)
+	if detail {
+		rurl += "&detail=1"
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*60))
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "GET", rurl, nil)
-	if err != nil {
-		return blocks, err
-	}
-	req.Header.Add("Accept", "application/json")
-	client := HttpClient(verbose)
-	resp, err := client.Do(req)
-	atomic.AddUint64(&TotalURLCalls, 1)
-	if err != nil {
-		if verbose {
-			log.Println("dbsCall client.Do", err)
+	known := make(map[string]bool)
+	err := dbsVisit(ctx, rurl, func(rec DBSBlock) error {
+		if rec.BlockName != "" && !known[rec.BlockName] {
+			known[rec.BlockName] = true
+			blocks = append(blocks, rec)
 		}
-		return blocks, err
-	}
-	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
-	var records []DBSBlock
-	err = json.Unmarshal(data, &records)
+		return nil
+	}, verbose)
 	if err != nil {
 		if verbose {
-			log.Println("dbsCall json.Unmarshal", err)
+			log.Println("dbsBlocks", err)
 		}
 		return nil, err
 	}
-	for _, rec := range records {
-		if !InList(rec.BlockName, blocks) {
-			if rec.BlockName != "" {
-				blocks = append(blocks, rec.BlockName)
-			}
-		}
-	}
 	return blocks, nil
 }
 
 // RunLumi represents run-lumi object
 type RunLumi struct {
-	Run  int `json:"run_num"`
-	Lumi int `json:"lumi_section_num"`
+	Run    int    `json:"run_num"`
+	Lumi   int    `json:"lumi_section_num"`
+	Events int64  `json:"event_count"`
+	LFN    string `json:"logical_file_name"`
 }
 
 // helper function to extract block ID from block name
@@ -121,33 +197,20 @@ func blockID(blk string) string {
 	return arr[1]
 }
 
-// SyncMap represents map to keep track of go routines
-// type SyncMap map[string]bool
-type SyncMap struct {
-	sync.Map
-}
-
-// Len implements map size function
-func (m *SyncMap) Len() int {
-	count := 0
-	m.Range(func(k, v any) bool {
-		count++
-		return true
-	})
-	return count
-}
-
 // Lumi represents part of filesummaries data structure
 type Lumi struct {
-	NumLumi int64 `json:"num_lumi"`
+	NumLumi  int64 `json:"num_lumi"`
+	NumEvent int64 `json:"num_event"`
+	NumFile  int64 `json:"num_file"`
 }
 
 // DbsListEntry identifies types used by list's generics function
 type DbsListEntry interface {
-	RunLumi | Lumi
+	RunLumi | Lumi | FileParent
 }
 
-func dbsApiCall[T DbsListEntry](rurl, bid string, verbose bool, out *[]T) {
+// helper function to fetch DBS API records in NDJSON data-format
+func dbsApiCall[T DbsListEntry](ctx context.Context, rurl, bid string, verbose bool) ([]T, error) {
 	time0 := time.Now()
 	defer func() {
 		if verbose {
@@ -157,55 +220,90 @@ func dbsApiCall[T DbsListEntry](rurl, bid string, verbose bool, out *[]T) {
 	if verbose {
 		log.Println("dbs call", rurl)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*60))
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "GET", rurl, nil)
-	if err != nil {
-		log.Println("ERROR: dbsApiCall new request", err)
-		return
-	}
-	req.Header.Add("Accept", "application/ndjson")
-	client := HttpClient(verbose)
-	resp, err := client.Do(req)
-	atomic.AddUint64(&TotalURLCalls, 1)
+	resp, err := upstreamGet(ctx, rurl, "application/ndjson", verbose)
 	if err != nil {
 		if verbose {
-			log.Println("ERROR: dbsApiCall client.Do", err)
+			log.Println("ERROR: dbsApiCall", err)
 		}
-		return
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	// we'll use json decoder to walk through our json stream (ndjson)
 	// see explanation about json decoder in this blog post:
 	// https://mottaquikarim.github.io/dev/posts/you-might-not-be-using-json.decoder-correctly-in-golang/
-	dec := json.NewDecoder(resp.Body)
-	for {
-		var rec T
-		err := dec.Decode(&rec)
-		if err == io.EOF {
-			return
+	var out []T
+	err = decodeStream(resp.Body, func(rec T) error {
+		out = append(out, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", rurl, err)
+	}
+	return out, nil
+}
+
+// BlocksError represents error of DBS calls for set of blocks
+type BlocksError struct {
+	Blocks []string // blocks we were unable to fetch
+	Errors []error  // corresponding errors
+}
+
+// Error implements error interface
+func (e *BlocksError) Error() string {
+	var msgs []string
+	for i, blk := range e.Blocks {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", blk, e.Errors[i]))
+	}
+	return fmt.Sprintf("unable to fetch %d block(s) from DBS: %s", len(e.Blocks), strings.Join(msgs, "; "))
+}
+
+// Add adds errors of another BlocksError skipping already known blocks
+func (e *BlocksError) Add(err *BlocksError) {
+	for i, blk := range err.Blocks {
+		if !InList(blk, e.Blocks) {
+			e.Blocks = append(e.Blocks, blk)
+			e.Errors = append(e.Errors, err.Errors[i])
 		}
-		*out = append(*out, rec)
 	}
 }
 
-// helper function to get unique number of lumis for given list of blocks
-func dbsBlocksLumis(blocks []string, verbose bool) (int64, int64, error) {
+// helper function to construct BlocksError from list of per-block errors
+func blocksError(blocks []string, errs []error) error {
+	berr := &BlocksError{}
+	for i, err := range errs {
+		if err != nil {
+			berr.Blocks = append(berr.Blocks, blocks[i])
+			berr.Errors = append(berr.Errors, err)
+		}
+	}
+	if len(berr.Blocks) == 0 {
+		return nil
+	}
+	return berr
+}
+
+// helper function to get run/lumi records for given list of blocks, the
+// records are returned in the same order as blocks
+func dbsBlocksLumis(ctx context.Context, dbsUrl string, blocks []string, verbose bool) ([][]RunLumi, error) {
 	time0 := time.Now()
-	var out []RunLumi
+	// each task stores its results and error in its own slot, this way
+	// tasks do not share any data and results are aggregated in blocks order
+	results := make([][]RunLumi, len(blocks))
+	errs := make([]error, len(blocks))
 	group := pool.Group()
-	for _, b := range blocks {
+	for i, b := range blocks {
 		if b == "" {
 			continue
 		}
+		idx := i
 		bid := blockID(b)
 		rurl := fmt.Sprintf("%s/filelumis?block_name=%s", dbsUrl, url.QueryEscape(b))
 
 		// usage of pool provides controlled (fixed size) environment to call DBS
 		// where at most we will place number of calls limited by max pool size
 		group.Submit(func() {
-			dbsApiCall(rurl, bid, verbose, &out)
+			results[idx], errs[idx] = dbsApiCall[RunLumi](ctx, rurl, bid, verbose)
 		})
 	}
 	group.Wait()
@@ -213,44 +311,28 @@ func dbsBlocksLumis(blocks []string, verbose bool) (int64, int64, error) {
 	if verbose {
 		log.Printf("Make %d calls to DBS to fetch block lumis in %s\n", len(blocks), time.Since(time0))
 	}
-	totalLumis := int64(len(out))
-	uniqueLumis := int64(len(uniqueRunLumis(out)))
-	return totalLumis, uniqueLumis, nil
+	return results, blocksError(blocks, errs)
 }
 
-// helper function to get unique number of RunLumi records
-func uniqueRunLumis(records []RunLumi) []RunLumi {
-	var out []RunLumi
-	for _, rec := range records {
-		found := false
-		for _, r := range out {
-			if r.Run == rec.Run && r.Lumi == rec.Lumi {
-				found = true
-			}
-		}
-		if !found {
-			out = append(out, rec)
-		}
-	}
-	return out
-}
-
-// helper function to get unique number of lumis for given list of blocks
-func dbsFilesummariesLumis(blocks []string, verbose bool) (int64, error) {
+// helper function to get filesummaries for given list of blocks, the
+// summaries are returned in the same order as blocks
+func dbsFilesummariesLumis(ctx context.Context, dbsUrl string, blocks []string, verbose bool) ([]Lumi, error) {
 	time0 := time.Now()
-	var out []Lumi
+	results := make([][]Lumi, len(blocks))
+	errs := make([]error, len(blocks))
 	group := pool.Group()
-	for _, b := range blocks {
+	for i, b := range blocks {
 		if b == "" {
 			continue
 		}
+		idx := i
 		bid := blockID(b)
 		rurl := fmt.Sprintf("%s/filesummaries?block_name=%s", dbsUrl, url.QueryEscape(b))
 
 		// usage of pool provides controlled (fixed size) environment to call DBS
 		// where at most we will place number of calls limited by max pool size
 		group.Submit(func() {
-			dbsApiCall(rurl, bid, verbose, &out)
+			results[idx], errs[idx] = dbsApiCall[Lumi](ctx, rurl, bid, verbose)
 		})
 	}
 	group.Wait()
@@ -258,80 +340,171 @@ func dbsFilesummariesLumis(blocks []string, verbose bool) (int64, error) {
 	if verbose {
 		log.Printf("Make %d calls to DBS to fetch block lumis in %s\n", len(blocks), time.Since(time0))
 	}
-	var totalLumis int64
-	for _, r := range out {
-		totalLumis += r.NumLumi
+	summaries := make([]Lumi, len(blocks))
+	for i, records := range results {
+		for _, r := range records {
+			summaries[i].NumLumi += r.NumLumi
+			summaries[i].NumEvent += r.NumEvent
+			summaries[i].NumFile += r.NumFile
+		}
 	}
-	return totalLumis, nil
+	return summaries, blocksError(blocks, errs)
 }
 
 // helper function to perform dbs call
-func dbsDatasetStats(input string, validFileOnly int, verbose bool) (*DBSRecord, error) {
+func dbsDatasetStats(ctx context.Context, dbsUrl, input string, validFileOnly int, verbose bool) (*DBSRecord, error) {
 	rurl := fmt.Sprintf("%s/filesummaries?dataset=%s", dbsUrl, input)
 	if validFileOnly == 1 {
 		rurl = fmt.Sprintf("%s/filesummaries?dataset=%s&validFileOnly=%d", dbsUrl, input, validFileOnly)
 	}
-	records, err := dbsCall(rurl, verbose)
+	records, err := dbsCall[DBSRecord](ctx, rurl, verbose)
 	if err != nil {
 		return nil, err
 	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no filesummaries records for %s: %w", input, ErrDatasetNotFound)
+	}
 	rec := records[0]
-	// find out number of valid files in given dataset
-	validFiles, err := dbsValidFiles(input, verbose)
-	if err == nil {
-		// the number of files includes all files (valid and invalid)
-		rec.NumInvalidFiles = rec.NumFiles - int64(len(validFiles))
+	// the number of files of the summary depends on validFileOnly, therefore
+	// we count invalid files of given dataset directly
+	invalid, err := dbsInvalidFiles(ctx, dbsUrl, input, verbose)
+	if err != nil {
+		return nil, err
 	}
-	return &rec, err
+	rec.NumInvalidFiles = int64(len(invalid))
+	rec.invalidFiles = invalid
+	return &rec, nil
 }
 
-// helper function to find out number of invalid files
-func dbsInvalidFiles(input string, verbose bool) ([]DBSRecord, error) {
-	rurl := fmt.Sprintf("%s/files?dataset=%s&validFileOnly=0", dbsUrl, input)
-	return dbsCall(rurl, verbose)
+// DBSFile represents files record we need to parse
+type DBSFile struct {
+	LogicalFileName string `json:"logical_file_name"`
+	BlockName       string `json:"block_name"`
+	FileSize        int64  `json:"file_size"`
+	EventCount      int64  `json:"event_count"`
+	IsFileValid     int    `json:"is_file_valid"`
 }
 
-// helper function to find out number of valid files
-func dbsValidFiles(input string, verbose bool) ([]DBSRecord, error) {
-	rurl := fmt.Sprintf("%s/files?dataset=%s&validFileOnly=1", dbsUrl, input)
-	return dbsCall(rurl, verbose)
+// helper function to find out invalid files, only invalid files are kept in
+// memory while files records are streamed from DBS
+func dbsInvalidFiles(ctx context.Context, dbsUrl, input string, verbose bool) ([]DBSFile, error) {
+	rurl := fmt.Sprintf("%s/files?dataset=%s&validFileOnly=0&detail=1", dbsUrl, input)
+	var out []DBSFile
+	err := dbsVisit(ctx, rurl, func(rec DBSFile) error {
+		if rec.IsFileValid == 0 {
+			out = append(out, rec)
+		}
+		return nil
+	}, verbose)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
+// DatasetInfo represents DBS datasets API record
+type DatasetInfo struct {
+	Dataset              string `json:"dataset"`
+	AccessType           string `json:"dataset_access_type"`
+	PhysicsGroup         string `json:"physics_group_name"`
+	CreationDate         int64  `json:"creation_date"`
+	LastModificationDate int64  `json:"last_modification_date"`
+	ProcessingVersion    int    `json:"processing_version"`
+}
 
-// helper function to perform dbs call
-func dbsCall(rurl string, verbose bool) ([]DBSRecord, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*60))
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "GET", rurl, nil)
+// helper function to get DBS dataset information, e.g. its access type,
+// creation and last modification dates (unix timestamps)
+func dbsDatasetInfo(ctx context.Context, dbsUrl, dataset string, verbose bool) (*DatasetInfo, error) {
+	rurl := fmt.Sprintf("%s/datasets?dataset=%s&detail=1&dataset_access_type=*", dbsUrl, dataset)
+	records, err := dbsCall[DatasetInfo](ctx, rurl, verbose)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Accept", "application/json")
-	client := HttpClient(verbose)
-	resp, err := client.Do(req)
-	atomic.AddUint64(&TotalURLCalls, 1)
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: %w", dataset, ErrDatasetNotFound)
+	}
+	return &records[0], nil
+}
+
+// helper function to perform dbs call and collect all records
+func dbsCall[T any](ctx context.Context, rurl string, verbose bool) ([]T, error) {
+	var records []T
+	err := dbsVisit(ctx, rurl, func(rec T) error {
+		records = append(records, rec)
+		return nil
+	}, verbose)
 	if err != nil {
-		if verbose {
-			log.Println("dbsCall client.Do", err)
-		}
 		return nil, err
 	}
-	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
-	var records []DBSRecord
+	return records, nil
+}
+
+// helper function to perform dbs call and pass every record to visit
+// function. The records are decoded from the stream one by one, therefore
+// the memory used to decode the stream does not depend on number of records
+// and it is up to visit function what to keep from them
+func dbsVisit[T any](ctx context.Context, rurl string, visit func(T) error, verbose bool) error {
+	if verbose {
+		log.Println("dbs call", rurl)
+	}
+	resp, err := upstreamGet(ctx, rurl, "application/ndjson", verbose)
 	if err != nil {
 		if verbose {
-			log.Println("dbsCall io.ReadAll", err)
+			log.Println("dbsVisit", err)
 		}
-		return nil, err
+		return err
 	}
-	err = json.Unmarshal(data, &records)
+	defer resp.Body.Close()
+	err = decodeStream(resp.Body, visit)
 	if err != nil {
-		if verbose {
-			log.Println("dbsCall json.Unmarshal", err)
-		}
-		return nil, err
+		return fmt.Errorf("unable to decode %s: %w", rurl, err)
 	}
-	return records, err
+	return nil
+}
 
+// helper function to decode stream of JSON records, the stream can be
+// either in NDJSON data-format or JSON array of records
+func decodeStream[T any](r io.Reader, visit func(T) error) error {
+	reader := bufio.NewReader(r)
+	// peek first non-space character to find out data-format
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\n' && b[0] != '\r' {
+			break
+		}
+		reader.ReadByte()
+	}
+	dec := json.NewDecoder(reader)
+	b, _ := reader.Peek(1)
+	array := b[0] == '['
+	if array {
+		// consume opening bracket of JSON array
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	for {
+		if array && !dec.More() {
+			// consume closing bracket of JSON array
+			_, err := dec.Token()
+			return err
+		}
+		var rec T
+		err := dec.Decode(&rec)
+		if err == io.EOF && !array {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := visit(rec); err != nil {
+			return err
+		}
+	}
 }
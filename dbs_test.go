@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alitto/pond"
+)
+
+// number of blocks and lumis per block served by fake DBS server
+const (
+	testBlocks        = 50
+	testBlockLumis    = 12
+	testBlockOverlaps = 2
+)
+
+// helper function to construct test block name
+func testBlockName(idx int) string {
+	return fmt.Sprintf("/A/B/RAW#%d", idx)
+}
+
+// helper function to start fake DBS server which serves filelumis and
+// filesummaries APIs in NDJSON data-format with random delays, the lumis
+// of consecutive blocks overlap by testBlockOverlaps lumis
+func fakeDBSServer() *httptest.Server {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var idx int
+		blk := r.URL.Query().Get("block_name")
+		_, err := fmt.Sscanf(blk, "/A/B/RAW#%d", &idx)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+		enc := json.NewEncoder(w)
+		if strings.HasSuffix(r.URL.Path, "/filelumis") {
+			first := idx * (testBlockLumis - testBlockOverlaps)
+			for i := 0; i < testBlockLumis; i++ {
+				enc.Encode(RunLumi{Run: 1, Lumi: first + i})
+			}
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/filesummaries") {
+			enc.Encode(Lumi{NumLumi: testBlockLumis})
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+// helper function to start fake DBS server which serves given records of DBS
+// APIs in NDJSON data-format, the records are looked up by API name and URL
+// encoded (with sorted keys) query, e.g. blocks?dataset=%2FA%2FB%2FRAW
+func fakeDBSApis(apis map[string][]any) *httptest.Server {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		key := fmt.Sprintf("%s?%s", path.Base(r.URL.Path), r.URL.Query().Encode())
+		records, ok := apis[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			enc.Encode(rec)
+		}
+	}
+	return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+// helper function to setup workers pool used by DBS calls
+func testPool() {
+	if pool == nil {
+		pool = pond.New(20, 1000)
+	}
+}
+
+// TestDbsBlocksLumis tests that concurrent fetch of block lumis is stable
+func TestDbsBlocksLumis(t *testing.T) {
+	testPool()
+	srv := fakeDBSServer()
+	defer srv.Close()
+
+	var blocks []string
+	for i := 0; i < testBlocks; i++ {
+		blocks = append(blocks, testBlockName(i))
+	}
+	expectTotal := int64(testBlocks * testBlockLumis)
+	expectUnique := int64(testBlocks*(testBlockLumis-testBlockOverlaps) + testBlockOverlaps)
+	for i := 0; i < 10; i++ {
+		results, err := dbsBlocksLumis(context.Background(), srv.URL, blocks, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total, lumis, _ := uniqueRunLumis(results)
+		if total != expectTotal {
+			t.Errorf("iteration %d: wrong total number of lumis %d, expect %d", i, total, expectTotal)
+		}
+		if unique := int64(lumis.Len()); unique != expectUnique {
+			t.Errorf("iteration %d: wrong unique number of lumis %d, expect %d", i, unique, expectUnique)
+		}
+	}
+}
+
+// TestDbsFilesummariesLumis tests that concurrent fetch of block summaries is stable
+func TestDbsFilesummariesLumis(t *testing.T) {
+	testPool()
+	srv := fakeDBSServer()
+	defer srv.Close()
+
+	var blocks []string
+	for i := 0; i < testBlocks; i++ {
+		blocks = append(blocks, testBlockName(i))
+	}
+	expect := int64(testBlocks * testBlockLumis)
+	for i := 0; i < 10; i++ {
+		summaries, err := dbsFilesummariesLumis(context.Background(), srv.URL, blocks, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, r := range summaries {
+			total += r.NumLumi
+		}
+		if total != expect {
+			t.Errorf("iteration %d: wrong number of lumis %d, expect %d", i, total, expect)
+		}
+	}
+}
+
+// TestDbsBlocksLumisErrors tests that failed blocks are reported
+func TestDbsBlocksLumisErrors(t *testing.T) {
+	testPool()
+	srv := fakeDBSServer()
+	defer srv.Close()
+
+	blocks := []string{testBlockName(0), "/A/B/RAW#bad", testBlockName(1)}
+	results, err := dbsBlocksLumis(context.Background(), srv.URL, blocks, false)
+	total, _, _ := uniqueRunLumis(results)
+	berr, ok := err.(*BlocksError)
+	if !ok {
+		t.Fatalf("expect BlocksError, got %v", err)
+	}
+	if len(berr.Blocks) != 1 || berr.Blocks[0] != "/A/B/RAW#bad" {
+		t.Errorf("wrong list of failed blocks %v", berr.Blocks)
+	}
+	if total != 2*testBlockLumis {
+		t.Errorf("wrong total number of lumis %d", total)
+	}
+}
+
+// helper function to get records of DBS APIs for dataset /A/B/RAW with
+// single block of three files, one of them is invalid
+func testDatasetApis() map[string][]any {
+	return map[string][]any{
+		"filesummaries?dataset=%2FA%2FB%2FRAW&validFileOnly=1": {
+			DBSRecord{NumFiles: 2, NumLumis: 3, NumEvents: 30, NumBlocks: 1},
+		},
+		"files?dataset=%2FA%2FB%2FRAW&detail=1&validFileOnly=0": {
+			DBSFile{LogicalFileName: "/a.root", BlockName: "/A/B/RAW#1", IsFileValid: 1},
+			DBSFile{LogicalFileName: "/b.root", BlockName: "/A/B/RAW#1", IsFileValid: 1},
+			DBSFile{LogicalFileName: "/c.root", BlockName: "/A/B/RAW#1", EventCount: 20},
+		},
+		"datasets?dataset=%2FA%2FB%2FRAW&dataset_access_type=%2A&detail=1": {
+			DatasetInfo{Dataset: "/A/B/RAW", AccessType: "VALID"},
+		},
+		"blocks?dataset=%2FA%2FB%2FRAW": {
+			DBSBlock{BlockName: "/A/B/RAW#1"},
+		},
+		"filelumis?block_name=%2FA%2FB%2FRAW%231": {
+			RunLumi{Run: 1, Lumi: 1, LFN: "/a.root"},
+			RunLumi{Run: 1, Lumi: 2, LFN: "/b.root"},
+			RunLumi{Run: 1, Lumi: 2, LFN: "/c.root"},
+			RunLumi{Run: 1, Lumi: 3, LFN: "/c.root"},
+		},
+		"filesummaries?block_name=%2FA%2FB%2FRAW%231": {
+			Lumi{NumLumi: 3, NumEvent: 30, NumFile: 2},
+		},
+	}
+}
+
+// TestDbsStatsInvalidFiles tests that invalid files are counted and lumis
+// present only in invalid files are reported as lost
+func TestDbsStatsInvalidFiles(t *testing.T) {
+	testPool()
+	srv := fakeDBSApis(testDatasetApis())
+	defer srv.Close()
+
+	rec, err := dbsStats(context.Background(), srv.URL, "/A/B/RAW", Details{InvalidFiles: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.NumInvalidFiles != 1 || rec.NumLostLumis != 1 {
+		t.Errorf("wrong number of invalid files %d or lost lumis %d", rec.NumInvalidFiles, rec.NumLostLumis)
+	}
+	if len(rec.InvalidFiles) != 1 || rec.InvalidFiles[0].LFN != "/c.root" || rec.InvalidFiles[0].NumLostLumis != 1 {
+		t.Errorf("wrong invalid files report %+v", rec.InvalidFiles)
+	}
+	if !reflect.DeepEqual(rec.LumiMask, LumiMask{1: {{1, 2}}}) {
+		t.Errorf("wrong lumi mask %v", rec.LumiMask)
+	}
+	// lumi 1:2 of invalid file is reprocessed into valid one
+	if rec.NumDuplicatedLumis != 0 || len(rec.DuplicatedLumis) != 0 || rec.dupLumis.Len() != 0 {
+		t.Errorf("wrong duplicated lumis %d %+v", rec.NumDuplicatedLumis, rec.DuplicatedLumis)
+	}
+	if rec.TotalFileLumis != 2 || rec.UniqueFileLumis != 2 {
+		t.Errorf("wrong number of file lumis %d or unique file lumis %d", rec.TotalFileLumis, rec.UniqueFileLumis)
+	}
+	metrics := make(map[string]float64)
+	statsMetrics(metrics, "output", rec)
+	if ratio := metrics["output.invalid_file_ratio"]; math.Abs(ratio-1.0/3) > 1e-9 {
+		t.Errorf("wrong invalid file ratio %v", ratio)
+	}
+}
+
+// TestDecodeStream tests decoding of NDJSON and JSON array streams
+func TestDecodeStream(t *testing.T) {
+	inputs := []string{
+		"{\"num_lumi\": 1}\n{\"num_lumi\": 2}\n{\"num_lumi\": 3}\n",
+		" [{\"num_lumi\": 1}, {\"num_lumi\": 2},\n{\"num_lumi\": 3}]",
+	}
+	for _, input := range inputs {
+		var total int64
+		err := decodeStream(strings.NewReader(input), func(rec Lumi) error {
+			total += rec.NumLumi
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 6 {
+			t.Errorf("wrong number of lumis %d for %q", total, input)
+		}
+	}
+	err := decodeStream(strings.NewReader(""), func(rec Lumi) error { return nil })
+	if err != nil {
+		t.Errorf("unexpected error for empty stream: %v", err)
+	}
+}
+
+// TestUpstreamGetRetries tests that transient failures of upstream calls are
+// retried and that circuit breaker fails fast when upstream is down
+func TestUpstreamGetRetries(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+	Config.RetryDelay = 1
+	Config.RetryMaxDelay = 5
+	Config.Retries = 3
+	Config.BreakerThreshold = 5
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1)%3 != 0 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[{"num_lumi": 1}]`))
+	}))
+	defer srv.Close()
+	records, err := dbsCall[Lumi](context.Background(), srv.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || calls != 3 {
+		t.Errorf("wrong number of records %d or calls %d", len(records), calls)
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+	_, err = dbsCall[Lumi](context.Background(), down.URL, false)
+	var herr *HTTPError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusBadGateway {
+		t.Errorf("expect HTTP 502 error, got %v", err)
+	}
+	_, err = dbsCall[Lumi](context.Background(), down.URL, false)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expect circuit breaker error, got %v", err)
+	}
+}
+
+// TestUpstreamGetRetryAfter tests that delay requested by Retry-After header
+// is honored beyond max backoff delay and calls are not retried if it
+// exceeds max delay of retry policy
+func TestUpstreamGetRetryAfter(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+	Config.RetryDelay = 1
+	Config.RetryMaxDelay = 5
+	Config.Retries = 3
+	Config.MaxRetryAfter = 1
+
+	var calls int32
+	var first time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			if elapsed := time.Since(first); elapsed < time.Second {
+				t.Errorf("retry after %s, expect at least 1s", elapsed)
+			}
+			w.Write([]byte(`[{"num_lumi": 1}]`))
+		default:
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	if _, err := dbsCall[Lumi](context.Background(), srv.URL, false); err != nil {
+		t.Fatal(err)
+	}
+	_, err := dbsCall[Lumi](context.Background(), srv.URL, false)
+	var herr *HTTPError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expect HTTP 503 error, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("wrong number of calls %d", calls)
+	}
+}
+
+// TestCircuitBreakerServices tests that failures of one service do not
+// open circuit breaker of another service on the same host
+func TestCircuitBreakerServices(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+	Config.Retries = -1
+	Config.BreakerThreshold = 2
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/dbs/") {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`[{"num_lumi": 1}]`))
+	}))
+	defer srv.Close()
+	for i := 0; i < 2; i++ {
+		dbsCall[Lumi](context.Background(), srv.URL+"/dbs/DBSReader/filesummaries", false)
+	}
+	_, err := dbsCall[Lumi](context.Background(), srv.URL+"/dbs/DBSReader/blocks", false)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expect circuit breaker error, got %v", err)
+	}
+	if _, err := dbsCall[Lumi](context.Background(), srv.URL+"/reqmgr2/data/request", false); err != nil {
+		t.Errorf("unexpected error of another service: %v", err)
+	}
+}
+
+// TestRetryableError tests which errors of upstream calls are retried
+func TestRetryableError(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&HTTPError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&HTTPError{StatusCode: http.StatusNotFound}, false},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, true},
+		{&url.Error{Op: "Get", Err: io.ErrUnexpectedEOF}, true},
+		{&url.Error{Op: "Get", Err: errors.New("unsupported protocol scheme")}, false},
+		{&url.Error{Op: "Get", Err: context.Canceled}, false},
+		{&TLSVerificationError{Host: "cmsweb.cern.ch", Err: errors.New("unknown authority")}, false},
+		{errors.New("unknown"), false},
+	}
+	for _, tt := range tests {
+		if retryable := retryableError(tt.err); retryable != tt.retryable {
+			t.Errorf("wrong retryable flag %v of %v", retryable, tt.err)
+		}
+	}
+}
+
+// TestCircuitBreaker tests that circuit breaker is opened when number of
+// failures reaches the threshold and its cooldown is not extended by
+// further failures
+func TestCircuitBreaker(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+	Config.BreakerThreshold = 2
+	breaker := &CircuitBreaker{failures: make(map[string]int), openUntil: make(map[string]time.Time)}
+	host := "dbs"
+	breaker.Failure(host)
+	if !breaker.Allow(host) {
+		t.Fatal("breaker is open before threshold")
+	}
+	breaker.Failure(host)
+	if breaker.Allow(host) {
+		t.Fatal("breaker is not open after threshold")
+	}
+	until := breaker.openUntil[host]
+	time.Sleep(time.Millisecond)
+	breaker.Failure(host)
+	if !breaker.openUntil[host].Equal(until) {
+		t.Errorf("cooldown is extended from %v to %v", until, breaker.openUntil[host])
+	}
+	breaker.Success(host)
+	if !breaker.Allow(host) {
+		t.Error("breaker is open after success")
+	}
+}
+
+// TestRateLimiter tests token bucket rate limiter
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(10, 2)
+	for i := 0; i < 2; i++ {
+		if delay := limiter.Reserve(); delay != 0 {
+			t.Errorf("call %d: unexpected delay %s within burst", i, delay)
+		}
+	}
+	if delay := limiter.Reserve(); delay < 90*time.Millisecond || delay > 100*time.Millisecond {
+		t.Errorf("wrong delay %s, expect ~100ms", delay)
+	}
+	if delay := NewRateLimiter(0, 0).Reserve(); delay != 0 {
+		t.Errorf("unexpected delay %s of unlimited rate", delay)
+	}
+}
+
+// TestRateLimiterCancel tests that cancelled calls do not use rate budget
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := NewRateLimiter(10, 1)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline error, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect cancel error, got %v", err)
+	}
+	// only first token is used, the next one is available in less than 100ms
+	if delay := limiter.Reserve(); delay <= 0 || delay > 100*time.Millisecond {
+		t.Errorf("wrong delay %s, expect less than 100ms", delay)
+	}
+}
+
+// TestHostLimiter tests per-host cap of concurrent calls
+func TestHostLimiter(t *testing.T) {
+	limiter := NewHostLimiter(2)
+	ctx := context.Background()
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := limiter.Acquire(ctx, "dbs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+	// host slots are exhausted while other hosts are not affected
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(tctx, "dbs"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline error, got %v", err)
+	}
+	octx, ocancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer ocancel()
+	if release, err := limiter.Acquire(octx, "reqmgr"); err != nil {
+		t.Errorf("unexpected error of another host %v", err)
+	} else {
+		release()
+	}
+
+	// slot is released once when response body is closed
+	acquired := make(chan func())
+	go func() {
+		release, err := limiter.Acquire(ctx, "dbs")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	body := &releaseBody{ReadCloser: io.NopCloser(strings.NewReader("")), release: releases[0]}
+	body.Close()
+	releases[0]()
+	select {
+	case release := <-acquired:
+		releases[0] = release
+	case <-time.After(time.Second):
+		t.Fatal("slot is not released by body close")
+	}
+	tctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(tctx, "dbs"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slot is released more than once, got %v", err)
+	}
+	for _, release := range releases {
+		release()
+	}
+	if release, err := limiter.Acquire(ctx, "dbs"); err != nil {
+		t.Errorf("unexpected error after release %v", err)
+	} else {
+		release()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+)
+
+// machine-readable error codes of workflow checks, the upstream service
+// specific codes are prefixed by service name, e.g. dbs_timeout
+const (
+	ErrCodeReqMgrNotFound = "reqmgr_not_found"
+	ErrCodeParseError     = "parse_error"
+	ErrCodeCancelled      = "cancelled"
+	ErrCodeInternal       = "internal_error"
+	errCodeNotFound       = "not_found"
+	errCodeTimeout        = "timeout"
+	errCodeUnavailable    = "unavailable"
+	errCodeHTTP5xx        = "http_5xx"
+	errCodeHTTP4xx        = "http_4xx"
+)
+
+// upstream services
+const (
+	ServiceReqMgr = "reqmgr"
+	ServiceDBS    = "dbs"
+)
+
+// ErrWorkflowNotFound represents error of workflow which is not found in ReqMgr2
+var ErrWorkflowNotFound = errors.New("workflow is not found in ReqMgr2")
+
+// ErrDatasetNotFound represents error of dataset which is not found in DBS
+var ErrDatasetNotFound = errors.New("dataset is not found in DBS")
+
+// CheckError represents error of workflow check along with upstream service
+// which caused it
+type CheckError struct {
+	Service string // upstream service, reqmgr or dbs
+	Err     error  // underlying error
+}
+
+// Error implements error interface
+func (e *CheckError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns underlying error
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// helper function to get error code of workflow check error
+func errorCode(err error) string {
+	service := ServiceDBS
+	var cerr *CheckError
+	if errors.As(err, &cerr) {
+		service = cerr.Service
+	}
+	var herr *HTTPError
+	var nerr net.Error
+	var serr *json.SyntaxError
+	var terr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, ErrWorkflowNotFound):
+		return ErrCodeReqMgrNotFound
+	case errors.Is(err, context.Canceled):
+		return ErrCodeCancelled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return service + "_" + errCodeTimeout
+	case errors.Is(err, ErrCircuitOpen):
+		return service + "_" + errCodeUnavailable
+	case errors.Is(err, ErrDatasetNotFound), errors.Is(err, fs.ErrNotExist):
+		return service + "_" + errCodeNotFound
+	case errors.As(err, &herr) && herr.StatusCode == http.StatusNotFound:
+		return service + "_" + errCodeNotFound
+	case errors.As(err, &herr) && herr.StatusCode >= 500:
+		return service + "_" + errCodeHTTP5xx
+	case errors.As(err, &herr):
+		return service + "_" + errCodeHTTP4xx
+	case errors.As(err, &serr), errors.As(err, &terr), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrCodeParseError
+	}
+	return ErrCodeInternal
+}
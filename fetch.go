@@ -1,62 +1,92 @@
 package main
 
 import (
-	"crypto/tls"
+	"bytes"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"os"
-	"os/user"
+	"path/filepath"
+	"strings"
 	"time"
-
-	"github.com/vkuznet/x509proxy"
 )
 
-// client X509 certificates
-func tlsCerts(verbose bool) ([]tls.Certificate, error) {
-	uproxy := os.Getenv("X509_USER_PROXY")
-	uckey := os.Getenv("X509_USER_KEY")
-	ucert := os.Getenv("X509_USER_CERT")
-
-	// check if /tmp/x509up_u$UID exists, if so setup X509_USER_PROXY env
-	u, err := user.Current()
-	if err == nil {
-		fname := fmt.Sprintf("/tmp/x509up_u%s", u.Uid)
-		if _, err := os.Stat(fname); err == nil {
-			uproxy = fname
-		}
+// HttpClient is HTTP client for urlfetch server, all clients share the same
+// transport provided by client manager
+func HttpClient(verbose bool) *http.Client {
+	var tr http.RoundTripper = tlsErrorTransport{Transport: clientManager.Transport(verbose)}
+	var rt http.RoundTripper = tr
+	if Config.Replay != "" {
+		rt = &replayTransport{Dir: Config.Replay, Verbose: verbose}
+	} else if Config.Record != "" {
+		rt = &recordTransport{Dir: Config.Record, Transport: tr, Verbose: verbose}
 	}
-	if uproxy == "" && uckey == "" { // user doesn't have neither proxy or user certs
-		return nil, nil
+	timeout := 60 * time.Second
+	if Config.Timeout > 0 {
+		timeout = time.Duration(Config.Timeout) * time.Second
 	}
-	if uproxy != "" {
-		// use local implementation of LoadX409KeyPair instead of tls one
-		x509cert, err := x509proxy.LoadX509Proxy(uproxy)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse X509 proxy: %v", err)
-		}
-		certs := []tls.Certificate{x509cert}
-		return certs, nil
+	return &http.Client{
+		Transport: rt,
+		Timeout:   timeout,
 	}
-	x509cert, err := tls.LoadX509KeyPair(ucert, uckey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse user X509 certificate: %v", err)
+}
+
+// HTTPError represents non-2xx HTTP response of upstream service
+type HTTPError struct {
+	Url        string // request url
+	StatusCode int    // HTTP status code
+	Body       string // response body
+}
+
+// Error implements error interface
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s returned HTTP %d: %s", e.Url, e.StatusCode, e.Body)
+}
+
+// helper function to check HTTP response status, the non-2xx responses are
+// converted into HTTPError which includes (part of) response body
+func checkResponse(rurl string, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
 	}
-	certs := []tls.Certificate{x509cert}
-	return certs, nil
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &HTTPError{Url: rurl, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
 }
 
-// HttpClient is HTTP client for urlfetch server
-func HttpClient(verbose bool) *http.Client {
-	certs, err := tlsCerts(verbose)
-	if err != nil {
-		log.Fatal(err)
+// fileTransport implements http.RoundTripper interface and serves requests
+// with file scheme from local files, e.g. file:///data/dbs/blocks?dataset=X
+// is served from /data/dbs/blocks/dataset=X.json file
+type fileTransport struct{}
+
+// RoundTrip implements http.RoundTripper interface
+func (t fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fname := req.URL.Path
+	if query := req.URL.Query().Encode(); query != "" {
+		fname = filepath.Join(fname, query)
 	}
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{Certificates: certs, InsecureSkipVerify: true},
+	fname = filepath.Clean(fmt.Sprintf("%s.json", fname))
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		Header:     make(http.Header),
+		Request:    req,
 	}
-	return &http.Client{
-		Transport: tr,
-		Timeout:   60 * time.Second,
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		resp.Status = "404 Not Found"
+		resp.StatusCode = http.StatusNotFound
+		data = []byte(fmt.Sprintf("no such file %s", fname))
+	} else if strings.Contains(req.Header.Get("Accept"), "ndjson") {
+		resp.Header.Set("Content-Type", "application/ndjson")
+	} else {
+		resp.Header.Set("Content-Type", "application/json")
 	}
+	resp.ContentLength = int64(len(data))
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, nil
 }
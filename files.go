@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sort"
+)
+
+// InvalidFile represents invalid file of a dataset
+type InvalidFile struct {
+	LFN          string `json:"logical_file_name"` // file name
+	BlockName    string `json:"block_name"`        // file block
+	FileSize     int64  `json:"file_size"`         // file size
+	EventCount   int64  `json:"event_count"`       // number of file events
+	NumLostLumis int    `json:"num_lost_lumis"`    // number of file lumis which are not present in valid files
+}
+
+// helper function to find run/lumi pairs which are present only in invalid
+// files. The records without file name are considered valid.
+func lostLumis(blockLumis [][]RunLumi, files []DBSFile) RunLumiSet {
+	lost := make(RunLumiSet)
+	if len(files) == 0 {
+		return lost
+	}
+	invalid := make(map[string]bool)
+	for _, f := range files {
+		invalid[f.LogicalFileName] = true
+	}
+	valid := make(RunLumiSet)
+	for _, records := range blockLumis {
+		for _, r := range records {
+			if r.LFN != "" && invalid[r.LFN] {
+				lost.Add(r.Run, r.Lumi)
+			} else {
+				valid.Add(r.Run, r.Lumi)
+			}
+		}
+	}
+	return lost.Difference(valid)
+}
+
+// helper function to drop run/lumi records of invalid files from given
+// blocks lumis. The records without file name are considered valid.
+func validRunLumis(blockLumis [][]RunLumi, files []DBSFile) [][]RunLumi {
+	if len(files) == 0 {
+		return blockLumis
+	}
+	invalid := make(map[string]bool)
+	for _, f := range files {
+		invalid[f.LogicalFileName] = true
+	}
+	out := make([][]RunLumi, 0, len(blockLumis))
+	for _, records := range blockLumis {
+		var valid []RunLumi
+		for _, r := range records {
+			if r.LFN != "" && invalid[r.LFN] {
+				continue
+			}
+			valid = append(valid, r)
+		}
+		out = append(out, valid)
+	}
+	return out
+}
+
+// helper function to construct invalid files report, the files are sorted
+// by their names
+func invalidFiles(files []DBSFile, blockLumis [][]RunLumi, lost RunLumiSet) []InvalidFile {
+	fileLumis := make(map[string]RunLumiSet)
+	for _, records := range blockLumis {
+		for _, r := range records {
+			if !lost.Contains(r.Run, r.Lumi) {
+				continue
+			}
+			lumis, ok := fileLumis[r.LFN]
+			if !ok {
+				lumis = make(RunLumiSet)
+				fileLumis[r.LFN] = lumis
+			}
+			lumis.Add(r.Run, r.Lumi)
+		}
+	}
+	var out []InvalidFile
+	for _, f := range files {
+		out = append(out, InvalidFile{
+			LFN:          f.LogicalFileName,
+			BlockName:    f.BlockName,
+			FileSize:     f.FileSize,
+			EventCount:   f.EventCount,
+			NumLostLumis: fileLumis[f.LogicalFileName].Len(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LFN < out[j].LFN })
+	return out
+}
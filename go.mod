@@ -3,8 +3,8 @@ module github.com/vkuznet/wflow-dbs
 go 1.19
 
 require (
+	github.com/alitto/pond v1.8.2
 	github.com/gorilla/mux v1.8.0
 	github.com/vkuznet/x509proxy v0.0.0-20210801171832-e47b94db99b6
+	gopkg.in/yaml.v3 v3.0.1
 )
-
-require github.com/alitto/pond v1.8.2 // indirect
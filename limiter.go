@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// default max number of concurrent calls to upstream host
+const defaultMaxHostConcurrency = 100
+
+// RateLimiter implements token bucket rate limiter, the bucket of burst
+// size is refilled with given rate of tokens per second
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64   // tokens per second, zero means no limit
+	burst  float64   // bucket size
+	tokens float64   // available tokens, negative value means reserved tokens
+	last   time.Time // last time tokens were refilled
+}
+
+// NewRateLimiter creates new rate limiter with given rate and burst size
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Reserve takes a token from the bucket and returns time to wait before
+// the token is available
+func (l *RateLimiter) Reserve() time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Cancel gives back token taken by Reserve which is not used
+func (l *RateLimiter) Cancel() {
+	if l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Wait blocks until token is available or context is done, the token of
+// cancelled call is given back to the bucket
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if err := sleep(ctx, l.Reserve()); err != nil {
+		l.Cancel()
+		return err
+	}
+	return nil
+}
+
+// HostLimiter limits number of concurrent calls per upstream host
+type HostLimiter struct {
+	mu    sync.Mutex
+	limit int                      // max number of concurrent calls per host
+	slots map[string]chan struct{} // semaphore per host
+}
+
+// NewHostLimiter creates new host limiter with given per-host limit
+func NewHostLimiter(limit int) *HostLimiter {
+	return &HostLimiter{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+// helper function to get semaphore of given host
+func (l *HostLimiter) semaphore(host string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.slots[host]
+	if !ok {
+		sem = make(chan struct{}, l.limit)
+		l.slots[host] = sem
+	}
+	return sem
+}
+
+// Acquire blocks until call to given host is allowed or context is done,
+// it returns function to release acquired slot
+func (l *HostLimiter) Acquire(ctx context.Context, host string) (func(), error) {
+	sem := l.semaphore(host)
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-sem })
+	}, nil
+}
+
+// limiters shared by all upstream calls of CLI and web modes
+var (
+	limitersOnce sync.Once
+	rateLimiter  *RateLimiter
+	hostLimiter  *HostLimiter
+)
+
+// helper function to get limiters of upstream calls, they are created on
+// first call using server configuration
+func limiters() (*RateLimiter, *HostLimiter) {
+	limitersOnce.Do(func() {
+		burst := Config.RateBurst
+		if burst <= 0 {
+			burst = int(Config.RateLimit)
+		}
+		rateLimiter = NewRateLimiter(Config.RateLimit, burst)
+		limit := Config.MaxHostConcurrency
+		if limit <= 0 {
+			limit = defaultMaxHostConcurrency
+		}
+		hostLimiter = NewHostLimiter(limit)
+	})
+	return rateLimiter, hostLimiter
+}
+
+// releaseBody implements io.ReadCloser interface and releases host slot
+// when response body is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+// Close implements io.Closer interface
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// helper function to sleep given time, it returns context error if context
+// is done before
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// maximum number of file names reported in lineage lists
+const maxLineageFiles = 100
+
+// Lineage represents parentage of dataset files with respect to its parent
+// dataset, i.e. every file should have parents which belong to parent dataset
+// and every parent file should be a parent of a single file
+type Lineage struct {
+	ParentDataset     string   `json:"parent_dataset"`            // expected parent dataset
+	ParentDatasets    []string `json:"parent_datasets"`           // output of datasetparents?dataset=xxx
+	NumFiles          int64    `json:"num_file"`                  // number of valid files of the dataset
+	NumOrphanFiles    int64    `json:"num_orphan_files"`          // number of files without parents
+	NumForeignParents int64    `json:"num_foreign_parents"`       // number of parent files outside of parent dataset
+	NumMultiParented  int64    `json:"num_multi_parented"`        // number of parent files with more than one child
+	OrphanFiles       []string `json:"orphan_files,omitempty"`    // files without parents
+	ForeignParents    []string `json:"foreign_parents,omitempty"` // parent files outside of parent dataset
+	MultiParented     []string `json:"multi_parented,omitempty"`  // parent files with more than one child
+}
+
+// DBSDatasetParent represents datasetparents record we need to parse
+type DBSDatasetParent struct {
+	ParentDataset string `json:"parent_dataset"`
+}
+
+// FileParent represents fileparents record
+type FileParent struct {
+	LogicalFileName string  `json:"logical_file_name"`
+	ParentFiles     LFNList `json:"parent_logical_file_name"`
+}
+
+// LFNList represents list of logical file names, DBS may provide either
+// single file name or list of them
+type LFNList []string
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (l *LFNList) UnmarshalJSON(data []byte) error {
+	var lfn string
+	if err := json.Unmarshal(data, &lfn); err == nil {
+		if lfn != "" {
+			*l = LFNList{lfn}
+		}
+		return nil
+	}
+	var lfns []string
+	if err := json.Unmarshal(data, &lfns); err != nil {
+		return err
+	}
+	*l = lfns
+	return nil
+}
+
+// helper function to get parent datasets of given dataset
+func dbsDatasetParents(ctx context.Context, dbsUrl, dataset string, verbose bool) ([]string, error) {
+	rurl := fmt.Sprintf("%s/datasetparents?dataset=%s", dbsUrl, dataset)
+	records, err := dbsCall[DBSDatasetParent](ctx, rurl, verbose)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, r := range records {
+		if r.ParentDataset != "" && !InList(r.ParentDataset, out) {
+			out = append(out, r.ParentDataset)
+		}
+	}
+	return out, nil
+}
+
+// helper function to get file parents for given list of blocks, the
+// records are returned in the same order as blocks
+func dbsBlocksParents(ctx context.Context, dbsUrl string, blocks []string, verbose bool) ([][]FileParent, error) {
+	time0 := time.Now()
+	results := make([][]FileParent, len(blocks))
+	errs := make([]error, len(blocks))
+	group := pool.Group()
+	for i, b := range blocks {
+		if b == "" {
+			continue
+		}
+		idx := i
+		bid := blockID(b)
+		rurl := fmt.Sprintf("%s/fileparents?block_name=%s", dbsUrl, url.QueryEscape(b))
+
+		// usage of pool provides controlled (fixed size) environment to call DBS
+		// where at most we will place number of calls limited by max pool size
+		group.Submit(func() {
+			results[idx], errs[idx] = dbsApiCall[FileParent](ctx, rurl, bid, verbose)
+		})
+	}
+	group.Wait()
+
+	if verbose {
+		log.Printf("Make %d calls to DBS to fetch file parents in %s\n", len(blocks), time.Since(time0))
+	}
+	return results, blocksError(blocks, errs)
+}
+
+// helper function to check lineage of dataset with respect to its parent
+// dataset using file parents of given dataset blocks. It finds files without
+// parents, parents which do not belong to parent dataset and parents of more
+// than one file. The files of dataset and its parent are streamed from DBS
+// and only file parents are kept in memory. If file parents of some blocks
+// can not be fetched from DBS the function returns lineage along with
+// BlocksError listing failed blocks
+func dbsLineage(ctx context.Context, dbsUrl, dataset, parent string, blocks []string, verbose bool) (*Lineage, error) {
+	parents, err := dbsDatasetParents(ctx, dbsUrl, dataset, verbose)
+	if err != nil {
+		return nil, err
+	}
+	blockParents, berr := dbsBlocksParents(ctx, dbsUrl, blocks, verbose)
+	if berr != nil {
+		log.Printf("ERROR: unable to call dbsBlocksParents for %s, %v", dataset, berr)
+		if _, ok := berr.(*BlocksError); !ok {
+			return nil, berr
+		}
+	}
+	lineage := &Lineage{ParentDataset: parent, ParentDatasets: parents}
+	hasParents := make(map[string]bool)
+	children := make(map[string]string)
+	multi := make(map[string]bool)
+	for _, records := range blockParents {
+		for _, r := range records {
+			for _, p := range r.ParentFiles {
+				hasParents[r.LogicalFileName] = true
+				if child, ok := children[p]; ok && child != r.LogicalFileName {
+					multi[p] = true
+				} else {
+					children[p] = r.LogicalFileName
+				}
+			}
+		}
+	}
+	for lfn := range multi {
+		lineage.NumMultiParented++
+		lineage.MultiParented = addLineageFile(lineage.MultiParented, lfn)
+	}
+
+	// parent files may be invalidated after processing, therefore we use
+	// all files of parent dataset, the parents which are not found among
+	// them are foreign
+	rurl := fmt.Sprintf("%s/files?dataset=%s&validFileOnly=0", dbsUrl, parent)
+	err = dbsVisit(ctx, rurl, func(rec DBSFile) error {
+		delete(children, rec.LogicalFileName)
+		return nil
+	}, verbose)
+	if err != nil {
+		return nil, err
+	}
+	for lfn := range children {
+		lineage.NumForeignParents++
+		lineage.ForeignParents = addLineageFile(lineage.ForeignParents, lfn)
+	}
+
+	// valid files of the dataset without parents are orphans
+	rurl = fmt.Sprintf("%s/files?dataset=%s&validFileOnly=1", dbsUrl, dataset)
+	err = dbsVisit(ctx, rurl, func(rec DBSFile) error {
+		lineage.NumFiles++
+		if !hasParents[rec.LogicalFileName] {
+			lineage.NumOrphanFiles++
+			lineage.OrphanFiles = addLineageFile(lineage.OrphanFiles, rec.LogicalFileName)
+		}
+		return nil
+	}, verbose)
+	if err != nil {
+		return nil, err
+	}
+	return lineage, berr
+}
+
+// helper function to add file name to sorted list of at most
+// maxLineageFiles smallest file names
+func addLineageFile(files []string, lfn string) []string {
+	idx := sort.SearchStrings(files, lfn)
+	if idx >= maxLineageFiles || (idx < len(files) && files[idx] == lfn) {
+		return files
+	}
+	files = append(files, "")
+	copy(files[idx+1:], files[idx:])
+	files[idx] = lfn
+	if len(files) > maxLineageFiles {
+		files = files[:maxLineageFiles]
+	}
+	return files
+}
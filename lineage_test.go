@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestDbsLineage tests orphan files, foreign parents and multi-parented
+// parents of dataset lineage
+func TestDbsLineage(t *testing.T) {
+	testPool()
+	srv := fakeDBSApis(map[string][]any{
+		"datasetparents?dataset=%2FA%2FC%2FAOD": {
+			DBSDatasetParent{ParentDataset: "/A/B/RAW"},
+		},
+		"fileparents?block_name=%2FA%2FC%2FAOD%231": {
+			// DBS provides either single parent or list of them
+			map[string]any{"logical_file_name": "/c1.root", "parent_logical_file_name": "/p1.root"},
+			FileParent{LogicalFileName: "/c2.root", ParentFiles: LFNList{"/p2.root", "/p3.root", "/p2.root"}},
+			FileParent{LogicalFileName: "/c3.root", ParentFiles: LFNList{"/p2.root"}},
+			map[string]any{"logical_file_name": "/c4.root", "parent_logical_file_name": "/x1.root"},
+		},
+		"fileparents?block_name=%2FA%2FC%2FAOD%232": {
+			map[string]any{"logical_file_name": "/c5.root", "parent_logical_file_name": ""},
+			map[string]any{"logical_file_name": "/c6.root", "parent_logical_file_name": nil},
+			map[string]any{"logical_file_name": "/c8.root", "parent_logical_file_name": []string{}},
+		},
+		"files?dataset=%2FA%2FB%2FRAW&validFileOnly=0": {
+			DBSFile{LogicalFileName: "/p1.root"},
+			DBSFile{LogicalFileName: "/p2.root"},
+			DBSFile{LogicalFileName: "/p3.root"},
+		},
+		// invalid file /c8.root without parents is not an orphan
+		"files?dataset=%2FA%2FC%2FAOD&validFileOnly=1": {
+			DBSFile{LogicalFileName: "/c1.root"},
+			DBSFile{LogicalFileName: "/c2.root"},
+			DBSFile{LogicalFileName: "/c3.root"},
+			DBSFile{LogicalFileName: "/c4.root"},
+			DBSFile{LogicalFileName: "/c5.root"},
+			DBSFile{LogicalFileName: "/c6.root"},
+			DBSFile{LogicalFileName: "/c7.root"},
+		},
+	})
+	defer srv.Close()
+
+	blocks := []string{"/A/C/AOD#1", "/A/C/AOD#2"}
+	lineage, err := dbsLineage(context.Background(), srv.URL, "/A/C/AOD", "/A/B/RAW", blocks, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &Lineage{
+		ParentDataset:     "/A/B/RAW",
+		ParentDatasets:    []string{"/A/B/RAW"},
+		NumFiles:          7,
+		NumOrphanFiles:    3,
+		NumForeignParents: 1,
+		NumMultiParented:  1,
+		OrphanFiles:       []string{"/c5.root", "/c6.root", "/c7.root"},
+		ForeignParents:    []string{"/x1.root"},
+		MultiParented:     []string{"/p2.root"},
+	}
+	if !reflect.DeepEqual(lineage, expect) {
+		t.Errorf("wrong lineage %+v, expect %+v", lineage, expect)
+	}
+
+	// file parents of missing block are reported as failed block
+	blocks = append(blocks, "/A/C/AOD#3")
+	lineage, err = dbsLineage(context.Background(), srv.URL, "/A/C/AOD", "/A/B/RAW", blocks, false)
+	berr, ok := err.(*BlocksError)
+	if !ok || !reflect.DeepEqual(berr.Blocks, []string{"/A/C/AOD#3"}) {
+		t.Fatalf("expect failed block /A/C/AOD#3, got %v", err)
+	}
+	if lineage == nil || lineage.NumOrphanFiles != 3 {
+		t.Errorf("wrong lineage of partial blocks %+v", lineage)
+	}
+}
+
+// TestAddLineageFile tests that lineage lists keep at most maxLineageFiles
+// smallest file names in sorted order
+func TestAddLineageFile(t *testing.T) {
+	var files, expect []string
+	for i := maxLineageFiles + 10; i > 0; i-- {
+		lfn := fmt.Sprintf("/f%03d.root", i)
+		files = addLineageFile(files, lfn)
+		files = addLineageFile(files, lfn)
+	}
+	for i := 1; i <= maxLineageFiles; i++ {
+		expect = append(expect, fmt.Sprintf("/f%03d.root", i))
+	}
+	if !reflect.DeepEqual(files, expect) {
+		t.Errorf("wrong lineage files %v", files)
+	}
+	files = addLineageFile(files, "/f999.root")
+	if len(files) != maxLineageFiles || !sort.StringsAreSorted(files) || files[len(files)-1] != expect[len(expect)-1] {
+		t.Errorf("wrong lineage files after adding larger file name %v", files)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// LumiMask represents CMS lumi-mask, i.e. map of run to list of lumi ranges
+// {"run": [[first,last],...]}
+type LumiMask map[int][][2]int
+
+// RunLumiSet represents set of run/lumi pairs, lumis of each run are kept
+// in a bitmap where bit N corresponds to lumi section N
+type RunLumiSet map[int][]uint64
+
+// Add adds run/lumi pair to the set, it returns false if pair already exists
+func (s RunLumiSet) Add(run, lumi int) bool {
+	if lumi < 0 {
+		return false
+	}
+	idx, bit := lumi/64, uint64(1)<<(lumi%64)
+	bitmap := s[run]
+	if idx >= len(bitmap) {
+		bitmap = append(bitmap, make([]uint64, idx-len(bitmap)+1)...)
+		s[run] = bitmap
+	}
+	if bitmap[idx]&bit != 0 {
+		return false
+	}
+	bitmap[idx] |= bit
+	return true
+}
+
+// Contains checks if run/lumi pair belongs to the set
+func (s RunLumiSet) Contains(run, lumi int) bool {
+	if lumi < 0 {
+		return false
+	}
+	bitmap := s[run]
+	idx := lumi / 64
+	if idx >= len(bitmap) {
+		return false
+	}
+	return bitmap[idx]&(uint64(1)<<(lumi%64)) != 0
+}
+
+// Len returns number of run/lumi pairs in the set
+func (s RunLumiSet) Len() int {
+	count := 0
+	for _, bitmap := range s {
+		for _, word := range bitmap {
+			count += bits.OnesCount64(word)
+		}
+	}
+	return count
+}
+
+// Runs returns sorted list of runs of the set
+func (s RunLumiSet) Runs() []int {
+	var runs []int
+	for run, bitmap := range s {
+		for _, word := range bitmap {
+			if word != 0 {
+				runs = append(runs, run)
+				break
+			}
+		}
+	}
+	sort.Ints(runs)
+	return runs
+}
+
+// Mask returns compressed lumi-mask representation of the set
+func (s RunLumiSet) Mask() LumiMask {
+	mask := make(LumiMask)
+	for run, bitmap := range s {
+		var ranges [][2]int
+		first := -1
+		for idx, word := range bitmap {
+			for b := 0; b < 64; b++ {
+				lumi := idx*64 + b
+				if word&(uint64(1)<<b) != 0 {
+					if first == -1 {
+						first = lumi
+					}
+				} else if first != -1 {
+					ranges = append(ranges, [2]int{first, lumi - 1})
+					first = -1
+				}
+			}
+		}
+		if first != -1 {
+			ranges = append(ranges, [2]int{first, len(bitmap)*64 - 1})
+		}
+		if len(ranges) != 0 {
+			mask[run] = ranges
+		}
+	}
+	return mask
+}
+
+// Difference returns set of run/lumi pairs which are not present in other set
+func (s RunLumiSet) Difference(other RunLumiSet) RunLumiSet {
+	out := make(RunLumiSet)
+	for run, bitmap := range s {
+		obitmap := other[run]
+		diff := make([]uint64, len(bitmap))
+		for idx, word := range bitmap {
+			if idx < len(obitmap) {
+				word &^= obitmap[idx]
+			}
+			diff[idx] = word
+		}
+		out[run] = diff
+	}
+	return out
+}
+
+// helper function to get total number of run/lumi records of given blocks,
+// set of unique run/lumi pairs and set of pairs which appear more than once
+func uniqueRunLumis(blockLumis [][]RunLumi) (int64, RunLumiSet, RunLumiSet) {
+	var total int64
+	lumis := make(RunLumiSet)
+	dups := make(RunLumiSet)
+	for _, records := range blockLumis {
+		for _, rec := range records {
+			total++
+			if !lumis.Add(rec.Run, rec.Lumi) {
+				dups.Add(rec.Run, rec.Lumi)
+			}
+		}
+	}
+	return total, lumis, dups
+}
+
+// maximum number of duplicated run/lumi pairs reported in DBS record
+const maxDuplicatedLumis = 100
+
+// DuplicatedLumi represents run/lumi pair present in more than one file
+type DuplicatedLumi struct {
+	Run    int      `json:"run_num"`           // run number
+	Lumi   int      `json:"lumi_section_num"`  // lumi section number
+	Files  []string `json:"logical_file_name"` // files containing the lumi
+	Events []int64  `json:"event_count"`       // number of lumi events in each file
+}
+
+// helper function to find run/lumi pairs which are present in more than
+// one file among pairs which appear in dataset more than once. It returns
+// set of such pairs, sorted list of at most maxDuplicatedLumis of them along
+// with their files and number of their events in extra files, i.e. all but
+// first file
+func duplicatedLumis(blockLumis [][]RunLumi, dups RunLumiSet) (RunLumiSet, []DuplicatedLumi, int64) {
+	out := make(RunLumiSet)
+	if dups.Len() == 0 {
+		return out, nil, 0
+	}
+	rmap := make(map[[2]int]*DuplicatedLumi)
+	for _, records := range blockLumis {
+		for _, r := range records {
+			if !dups.Contains(r.Run, r.Lumi) {
+				continue
+			}
+			key := [2]int{r.Run, r.Lumi}
+			d, ok := rmap[key]
+			if !ok {
+				d = &DuplicatedLumi{Run: r.Run, Lumi: r.Lumi}
+				rmap[key] = d
+			}
+			if !InList(r.LFN, d.Files) {
+				d.Files = append(d.Files, r.LFN)
+				d.Events = append(d.Events, r.Events)
+			}
+		}
+	}
+	var records []DuplicatedLumi
+	var numEvents int64
+	for _, d := range rmap {
+		if len(d.Files) < 2 {
+			continue
+		}
+		for _, events := range d.Events[1:] {
+			numEvents += events
+		}
+		out.Add(d.Run, d.Lumi)
+		records = append(records, *d)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Run != records[j].Run {
+			return records[i].Run < records[j].Run
+		}
+		return records[i].Lumi < records[j].Lumi
+	})
+	if len(records) > maxDuplicatedLumis {
+		records = records[:maxDuplicatedLumis]
+	}
+	return out, records, numEvents
+}
+
+// LumiDiff represents difference of run/lumi pairs of input and output datasets
+type LumiDiff struct {
+	Missing       LumiMask `json:"missing"`        // lumis of input dataset missing in output
+	Extra         LumiMask `json:"extra"`          // lumis of output dataset not present in input
+	Duplicated    LumiMask `json:"duplicated"`     // lumis of output dataset present in more than one file
+	NumMissing    int      `json:"num_missing"`    // number of missing lumis
+	NumExtra      int      `json:"num_extra"`      // number of extra lumis
+	NumDuplicated int      `json:"num_duplicated"` // number of duplicated lumis
+}
+
+// helper function to compare run/lumi pairs of input and output datasets,
+// only input lumis accepted by request restrictions are expected in output
+func lumiDiff(restrictions InputRestrictions, istats, ostats *DBSRecord) *LumiDiff {
+	input := restrictions.acceptedLumis(istats)
+	missing := input.Difference(ostats.lumis)
+	extra := ostats.lumis.Difference(input)
+	return &LumiDiff{
+		Missing:       missing.Mask(),
+		Extra:         extra.Mask(),
+		Duplicated:    ostats.dupLumis.Mask(),
+		NumMissing:    missing.Len(),
+		NumExtra:      extra.Len(),
+		NumDuplicated: ostats.dupLumis.Len(),
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// helper function to construct DBS record with run/lumi sets of given
+// block lumis in the same way as dbsStats does
+func testLumisRecord(blockLumis [][]RunLumi) *DBSRecord {
+	_, lumis, candidates := uniqueRunLumis(blockLumis)
+	dups, _, _ := duplicatedLumis(blockLumis, candidates)
+	return &DBSRecord{lumis: lumis, dupLumis: dups}
+}
+
+// TestLumiDiff tests difference of run/lumi pairs of input and output datasets
+func TestLumiDiff(t *testing.T) {
+	istats := testLumisRecord([][]RunLumi{
+		{{Run: 1, Lumi: 1, LFN: "in1"}, {Run: 1, Lumi: 2, LFN: "in1"}, {Run: 1, Lumi: 3, LFN: "in1"}},
+		{{Run: 2, Lumi: 1, LFN: "in2"}, {Run: 2, Lumi: 2, LFN: "in2"}},
+	})
+	ostats := testLumisRecord([][]RunLumi{
+		// lumi 1:1 is present in two files, lumi 1:2 twice in the same file
+		{{Run: 1, Lumi: 1, LFN: "out1"}, {Run: 1, Lumi: 2, LFN: "out1"}, {Run: 1, Lumi: 2, LFN: "out1"}},
+		{{Run: 1, Lumi: 1, LFN: "out2"}, {Run: 2, Lumi: 1, LFN: "out2"}, {Run: 3, Lumi: 7, LFN: "out2"}},
+	})
+	diff := lumiDiff(InputRestrictions{}, istats, ostats)
+	expect := &LumiDiff{
+		Missing:       LumiMask{1: {{3, 3}}, 2: {{2, 2}}},
+		Extra:         LumiMask{3: {{7, 7}}},
+		Duplicated:    LumiMask{1: {{1, 1}}},
+		NumMissing:    2,
+		NumExtra:      1,
+		NumDuplicated: 1,
+	}
+	if !reflect.DeepEqual(diff, expect) {
+		t.Errorf("wrong lumi diff %+v, expect %+v", diff, expect)
+	}
+}
+
+// TestRunLumiSet tests run/lumi set operations and its lumi-mask at 64-bit
+// word boundaries and for runs with gaps
+func TestRunLumiSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs [][2]int
+		mask  LumiMask
+		runs  []int
+	}{
+		{"empty", nil, LumiMask{}, nil},
+		{"lumi 63", [][2]int{{1, 63}}, LumiMask{1: {{63, 63}}}, []int{1}},
+		{"lumi 64", [][2]int{{1, 64}}, LumiMask{1: {{64, 64}}}, []int{1}},
+		{"lumi 65", [][2]int{{1, 65}}, LumiMask{1: {{65, 65}}}, []int{1}},
+		{"range across words", [][2]int{{1, 63}, {1, 64}, {1, 65}}, LumiMask{1: {{63, 65}}}, []int{1}},
+		{"range till word end", [][2]int{{1, 62}, {1, 63}}, LumiMask{1: {{62, 63}}}, []int{1}},
+		{"range from word start", [][2]int{{1, 64}, {1, 65}, {1, 128}}, LumiMask{1: {{64, 65}, {128, 128}}}, []int{1}},
+		{"gap at boundary", [][2]int{{1, 62}, {1, 63}, {1, 65}}, LumiMask{1: {{62, 63}, {65, 65}}}, []int{1}},
+		{"lumi 0", [][2]int{{1, 0}, {1, 1}}, LumiMask{1: {{0, 1}}}, []int{1}},
+		{"runs with gaps", [][2]int{{5, 1}, {5, 2}, {5, 10}, {3, 7}, {1000, 200}}, LumiMask{3: {{7, 7}}, 5: {{1, 2}, {10, 10}}, 1000: {{200, 200}}}, []int{3, 5, 1000}},
+	}
+	for _, tt := range tests {
+		set := make(RunLumiSet)
+		for _, p := range tt.pairs {
+			if !set.Add(p[0], p[1]) {
+				t.Errorf("%s: pair %v is not added", tt.name, p)
+			}
+			if set.Add(p[0], p[1]) {
+				t.Errorf("%s: pair %v is added twice", tt.name, p)
+			}
+		}
+		for _, p := range tt.pairs {
+			if !set.Contains(p[0], p[1]) {
+				t.Errorf("%s: set does not contain %v", tt.name, p)
+			}
+		}
+		for _, lumi := range []int{63, 64, 65} {
+			if set.Contains(2, lumi) {
+				t.Errorf("%s: set contains unknown run 2 lumi %d", tt.name, lumi)
+			}
+		}
+		if set.Len() != len(tt.pairs) {
+			t.Errorf("%s: wrong length %d, expect %d", tt.name, set.Len(), len(tt.pairs))
+		}
+		if mask := set.Mask(); !reflect.DeepEqual(mask, tt.mask) {
+			t.Errorf("%s: wrong lumi mask %v, expect %v", tt.name, mask, tt.mask)
+		}
+		if runs := set.Runs(); !reflect.DeepEqual(runs, tt.runs) {
+			t.Errorf("%s: wrong runs %v, expect %v", tt.name, runs, tt.runs)
+		}
+	}
+	// neighbouring lumis of the same word are not members of the set
+	set := make(RunLumiSet)
+	set.Add(1, 64)
+	for _, lumi := range []int{-1, 63, 65, 127, 128} {
+		if set.Contains(1, lumi) {
+			t.Errorf("set contains lumi %d", lumi)
+		}
+	}
+	if set.Add(1, -1) {
+		t.Error("negative lumi is added")
+	}
+}
+
+// TestRunLumiSetDifference tests difference of run/lumi sets of different
+// bitmap lengths
+func TestRunLumiSetDifference(t *testing.T) {
+	a, b := make(RunLumiSet), make(RunLumiSet)
+	for _, lumi := range []int{1, 63, 64, 65, 200} {
+		a.Add(1, lumi)
+	}
+	a.Add(2, 1)
+	b.Add(1, 64)
+	b.Add(1, 1000)
+	diff := a.Difference(b)
+	expect := LumiMask{1: {{1, 1}, {63, 63}, {65, 65}, {200, 200}}, 2: {{1, 1}}}
+	if mask := diff.Mask(); !reflect.DeepEqual(mask, expect) {
+		t.Errorf("wrong difference %v, expect %v", mask, expect)
+	}
+}
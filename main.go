@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alitto/pond"
@@ -25,7 +28,7 @@ var pool *pond.WorkerPool
 // Info function returns version string of the server
 func info() string {
 	goVersion := runtime.Version()
-	tstamp := time.Now().Format("2006-02-01")
+	tstamp := time.Now().Format("2006-01-02")
 	return fmt.Sprintf("wflow-dbs git=%s go=%s date=%s", gitVersion, goVersion, tstamp)
 }
 
@@ -36,6 +39,34 @@ func main() {
 	flag.StringVar(&workflow, "workflow", "workflow.json", "workflow file")
 	var verbose bool
 	flag.BoolVar(&verbose, "verbose", false, "Show verbose")
+	var dbsUrl string
+	flag.StringVar(&dbsUrl, "dbsUrl", "", "DBS url, e.g. https://cmsweb.cern.ch/dbs/prod/global/DBSReader")
+	var dbsInstance string
+	flag.StringVar(&dbsInstance, "dbsInstance", "", "DBS instance, e.g. prod/phys03")
+	var reqmgrUrl string
+	flag.StringVar(&reqmgrUrl, "reqmgrUrl", "", "ReqMgr2 url, e.g. https://cmsweb.cern.ch/reqmgr2")
+	var fixtures string
+	flag.StringVar(&fixtures, "fixtures", "", "directory with ReqMgr2 and DBS responses to use instead of cmsweb services")
+	var record string
+	flag.StringVar(&record, "record", "", "record all upstream HTTP calls into given directory")
+	var replay string
+	flag.StringVar(&replay, "replay", "", "replay upstream HTTP calls from given directory")
+	var rules string
+	flag.StringVar(&rules, "rules", "", "JSON or YAML file with status rules")
+	var detail string
+	flag.StringVar(&detail, "detail", "", "comma separated list of DBS statistics details: blocks, invalid_files")
+	var caPath string
+	flag.StringVar(&caPath, "caPath", "", "CA certificates directory or bundle file, default X509_CERT_DIR or /etc/grid-security/certificates")
+	var insecure bool
+	flag.BoolVar(&insecure, "insecure", false, "skip TLS verification of upstream services")
+	var retries int
+	flag.IntVar(&retries, "retries", 0, "max number of retries of upstream calls (default 3, negative disables retries)")
+	var rateLimit float64
+	flag.Float64Var(&rateLimit, "rateLimit", 0, "max rate of upstream calls per second (default no limit)")
+	var maxHostConcurrency int
+	flag.IntVar(&maxHostConcurrency, "maxHostConcurrency", 0, "max number of concurrent calls per upstream host (default 100)")
+	var workflowTimeout int
+	flag.IntVar(&workflowTimeout, "workflowTimeout", 0, "deadline of workflow check in seconds (default 600)")
 	var version bool
 	flag.BoolVar(&version, "version", false, "Show version")
 	flag.Parse()
@@ -52,21 +83,82 @@ func main() {
 	pool = pond.New(100, 1000)
 	defer pool.StopAndWait()
 
+	if webConfig != "" {
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+		err := parseConfig(webConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err := initEndpoints(dbsUrl, dbsInstance, reqmgrUrl)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if fixtures != "" {
+		Config.Fixtures = fixtures
+	}
+	if record != "" {
+		Config.Record = record
+	}
+	if replay != "" {
+		Config.Replay = replay
+	}
+	if rules != "" {
+		Config.Rules = rules
+	}
+	if caPath != "" {
+		Config.CAPath = caPath
+	}
+	if insecure {
+		Config.Insecure = true
+	}
+	if retries != 0 {
+		Config.Retries = retries
+	}
+	if rateLimit > 0 {
+		Config.RateLimit = rateLimit
+	}
+	if maxHostConcurrency > 0 {
+		Config.MaxHostConcurrency = maxHostConcurrency
+	}
+	if workflowTimeout > 0 {
+		Config.WorkflowTimeout = workflowTimeout
+	}
+	if Config.Rules != "" {
+		StatusRules, err = loadRules(Config.Rules)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if Config.Record != "" && Config.Replay != "" {
+		log.Fatal("record and replay modes are mutually exclusive")
+	}
+	if Config.Record != "" {
+		err := os.MkdirAll(Config.Record, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if webConfig == "" {
 		time0 := time.Now()
 		wflows := strings.Split(workflow, ",")
 		var out []Record
-		var err error
-		if len(wflows) == 1 {
-			out, err = check(workflow, verbose)
-		} else {
-			out, err = concurrentCheck(wflows, verbose)
+		details, err := parseDetails(detail)
+		if err != nil {
+			log.Fatal(err)
 		}
+		wsrc, dsrc := newSources(Config.Fixtures, Config.ReqMgrUrl, Config.DBSUrl, details, verbose)
+		// cancel all upstream calls when user interrupts the check
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		out, err = concurrentCheck(ctx, wflows, wsrc, dsrc, verbose)
 		if err != nil {
 			log.Fatal(err)
 		}
 		if verbose {
-			fmt.Printf("Total number of URL calls %d, elapsed time %v\n", TotalURLCalls, time.Since(time0))
+			log.Printf("Total number of URL calls %d, retries %d, elapsed time %v", TotalURLCalls, TotalRetries, time.Since(time0))
 		}
 		// construct output JSON
 		data, err := json.MarshalIndent(out, "", "   ")
@@ -74,7 +166,10 @@ func main() {
 			log.Fatal(err)
 		}
 		fmt.Println(string(data))
+		if failedRecords(out) != 0 {
+			os.Exit(1)
+		}
 		return
 	}
-	server(webConfig)
+	server()
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+)
+
+// PileupRecord represents DBS statistics of pileup dataset
+type PileupRecord struct {
+	Dataset         string `json:"dataset"`             // pileup dataset name
+	Type            string `json:"type"`                // MCPileup or DataPileup
+	AccessType      string `json:"dataset_access_type"` // DBS dataset access type
+	NumFiles        int64  `json:"num_file"`            // number of files
+	NumEvents       int64  `json:"num_event"`           // number of events
+	NumBlocks       int64  `json:"num_block"`           // number of blocks
+	NumInvalidFiles int64  `json:"num_invalid_files"`   // number of invalid files
+	Failed          bool   `json:"failed,omitempty"`    // pileup we were unable to fetch from DBS
+	Error           string `json:"error,omitempty"`     // error of DBS calls
+}
+
+// helper function to get DBS statistics of pileup dataset, the dataset
+// access type is taken from DBS datasets API and number of invalid files
+// from DBS files API
+func dbsPileupStats(ctx context.Context, dbsUrl, dataset string, verbose bool) (*PileupRecord, error) {
+	info, err := dbsDatasetInfo(ctx, dbsUrl, dataset, verbose)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := dbsDatasetStats(ctx, dbsUrl, dataset, 0, verbose)
+	if err != nil {
+		return nil, err
+	}
+	return &PileupRecord{
+		Dataset:         dataset,
+		AccessType:      info.AccessType,
+		NumFiles:        rec.NumFiles,
+		NumEvents:       rec.NumEvents,
+		NumBlocks:       rec.NumBlocks,
+		NumInvalidFiles: rec.NumInvalidFiles,
+	}, nil
+}
+
+// helper function to get pileup datasets of the request along with their
+// types, the pileup can be defined at request level or within its tasks
+func pileupDatasets(rec *ReqMgrRecord) map[string]string {
+	out := make(map[string]string)
+	add := func(mcPileup, dataPileup Text) {
+		if mcPileup != "" {
+			out[string(mcPileup)] = "MCPileup"
+		}
+		if dataPileup != "" {
+			out[string(dataPileup)] = "DataPileup"
+		}
+	}
+	add(rec.MCPileup, rec.DataPileup)
+	for _, task := range rec.Tasks {
+		add(task.MCPileup, task.DataPileup)
+	}
+	return out
+}
+
+// pileupCache implements DatasetStatsSource interface and caches pileup
+// statistics of underlying source, this way pileup datasets shared by many
+// workflows, e.g. MinBias, are fetched from DBS once per concurrent check.
+// The concurrent calls for the same pileup dataset wait for the first one,
+// while failed calls are not cached since they can be caused by
+// cancellation of workflow check which made the call.
+type pileupCache struct {
+	DatasetStatsSource
+	mu      sync.Mutex
+	entries map[string]*pileupEntry
+}
+
+// pileupEntry represents cached pileup statistics, the done channel is
+// closed when statistics are fetched
+type pileupEntry struct {
+	done chan struct{}
+	rec  *PileupRecord
+	err  error
+}
+
+// helper function to construct pileup cache of given source
+func newPileupCache(dsrc DatasetStatsSource) *pileupCache {
+	return &pileupCache{DatasetStatsSource: dsrc, entries: make(map[string]*pileupEntry)}
+}
+
+// PileupStats implements DatasetStatsSource interface
+func (c *pileupCache) PileupStats(ctx context.Context, dataset string) (*PileupRecord, error) {
+	for {
+		c.mu.Lock()
+		entry, ok := c.entries[dataset]
+		if !ok {
+			entry = &pileupEntry{done: make(chan struct{})}
+			c.entries[dataset] = entry
+			c.mu.Unlock()
+			entry.rec, entry.err = c.DatasetStatsSource.PileupStats(ctx, dataset)
+			if entry.err != nil {
+				c.mu.Lock()
+				delete(c.entries, dataset)
+				c.mu.Unlock()
+			}
+			close(entry.done)
+			return entry.copy()
+		}
+		c.mu.Unlock()
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if entry.err == nil {
+			return entry.copy()
+		}
+		// call of another workflow failed, we make our own call
+	}
+}
+
+// helper function to get copy of cached pileup statistics, the callers
+// modify pileup records, e.g. set pileup type
+func (e *pileupEntry) copy() (*PileupRecord, error) {
+	if e.err != nil || e.rec == nil {
+		return e.rec, e.err
+	}
+	rec := *e.rec
+	return &rec, nil
+}
+
+// helper function to get DBS statistics of all pileup datasets of the request,
+// the pileup datasets we fail to fetch from DBS are reported as failed while
+// error is returned only if workflow check is cancelled
+func pileupStats(ctx context.Context, rec *ReqMgrRecord, dsrc DatasetStatsSource) ([]PileupRecord, error) {
+	var out []PileupRecord
+	pileups := pileupDatasets(rec)
+	var datasets []string
+	for dataset := range pileups {
+		datasets = append(datasets, dataset)
+	}
+	sort.Strings(datasets)
+	for _, dataset := range datasets {
+		ptype := pileups[dataset]
+		prec, err := dsrc.PileupStats(ctx, dataset)
+		if ctx.Err() != nil {
+			return out, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("ERROR: unable to get DBS data for pileup %s, %v", dataset, err)
+			prec = &PileupRecord{Dataset: dataset, Failed: true, Error: err.Error()}
+		}
+		prec.Type = ptype
+		out = append(out, *prec)
+	}
+	return out, nil
+}
+
+// helper function to check that pileup datasets are VALID and do not have
+// invalid files, the pileup datasets we fail to fetch from DBS raise error
+func pileupResults(records []PileupRecord) []RuleResult {
+	var out []RuleResult
+	for _, r := range records {
+		if r.Failed {
+			out = append(out, RuleResult{
+				Rule:     "failed_pileup",
+				Dataset:  r.Dataset,
+				Severity: StatusError,
+				Expected: 0,
+				Actual:   1,
+			})
+			continue
+		}
+		res := RuleResult{
+			Rule:     "pileup_access_type",
+			Dataset:  r.Dataset,
+			Severity: StatusOK,
+			Expected: "VALID",
+			Actual:   r.AccessType,
+		}
+		if r.AccessType != "VALID" {
+			res.Severity = StatusWarning
+		}
+		out = append(out, res)
+		res = RuleResult{
+			Rule:     "pileup_invalid_files",
+			Dataset:  r.Dataset,
+			Severity: StatusOK,
+			Expected: 0,
+			Actual:   r.NumInvalidFiles,
+		}
+		if r.NumInvalidFiles != 0 {
+			res.Severity = StatusWarning
+		}
+		out = append(out, res)
+	}
+	return out
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// HTTPRecord represents recorded HTTP request and its response
+type HTTPRecord struct {
+	Method        string      `json:"method"`         // HTTP method
+	Url           string      `json:"url"`            // request url
+	RequestHeader http.Header `json:"request_header"` // request HTTP headers
+	StatusCode    int         `json:"status_code"`    // response status code
+	Status        string      `json:"status"`         // response status
+	Header        http.Header `json:"header"`         // response HTTP headers
+	Body          []byte      `json:"body"`           // response body
+}
+
+// helper function to get record file name for given HTTP request
+func recordFile(dir string, req *http.Request) string {
+	key := fmt.Sprintf("%s %s", req.Method, req.URL.String())
+	return filepath.Join(dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+// recordTransport implements http.RoundTripper interface and stores every
+// HTTP request along with its response in a given directory
+type recordTransport struct {
+	Dir       string            // record directory
+	Transport http.RoundTripper // underlying transport
+	Verbose   bool              // verbose mode
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	rec := HTTPRecord{
+		Method:        req.Method,
+		Url:           req.URL.String(),
+		RequestHeader: req.Header,
+		StatusCode:    resp.StatusCode,
+		Status:        resp.Status,
+		Header:        resp.Header,
+		Body:          body,
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	fname := recordFile(t.Dir, req)
+	if t.Verbose {
+		log.Printf("record %s into %s", rec.Url, fname)
+	}
+	err = os.WriteFile(fname, data, 0644)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// replayTransport implements http.RoundTripper interface and serves
+// HTTP requests from records stored by recordTransport
+type replayTransport struct {
+	Dir     string // record directory
+	Verbose bool   // verbose mode
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fname := recordFile(t.Dir, req)
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("no recorded response for %s %s: %w", req.Method, req.URL.String(), err)
+	}
+	var rec HTTPRecord
+	err = json.Unmarshal(data, &rec)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", fname, err)
+	}
+	if t.Verbose {
+		log.Printf("replay %s from %s", rec.Url, fname)
+	}
+	return &http.Response{
+		Status:        rec.Status,
+		StatusCode:    rec.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header,
+		Body:          io.NopCloser(bytes.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       req,
+	}, nil
+}
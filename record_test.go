@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestRecordReplay tests that upstream calls recorded from DBS server are
+// replayed when server is not available
+func TestRecordReplay(t *testing.T) {
+	testPool()
+	config := Config
+	defer func() { Config = config }()
+	dir := t.TempDir()
+	srv := fakeDBSApis(testDatasetApis())
+	dbsUrl := srv.URL
+	details := Details{Blocks: false, InvalidFiles: true}
+
+	Config.Record = dir
+	recorded, err := dbsStats(context.Background(), dbsUrl, "/A/B/RAW", details, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// filesummaries, files, datasets, blocks, filelumis and block filesummaries
+	if len(files) != 6 {
+		t.Errorf("wrong number of recorded calls %d", len(files))
+	}
+
+	Config.Record = ""
+	Config.Replay = dir
+	replayed, err := dbsStats(context.Background(), dbsUrl, "/A/B/RAW", details, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(recorded, replayed) {
+		t.Errorf("replayed record %+v differs from recorded one %+v", replayed, recorded)
+	}
+	if replayed.NumInvalidFiles != 1 || len(replayed.InvalidFiles) != 1 {
+		t.Errorf("wrong replayed record %+v", replayed)
+	}
+	if _, err := dbsStats(context.Background(), dbsUrl, "/A/C/AOD", details, false); err == nil {
+		t.Error("no error for call which is not recorded")
+	}
+}
@@ -3,13 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
-	"sync/atomic"
-	"time"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
 )
 
 // WorkflowRecord represent reqmgr map record
@@ -20,45 +20,358 @@ type ResultRecord struct {
 	Result []WorkflowRecord
 }
 
-// Task represents task structure of ReqMgr2
+// InputRestrictions represents ReqMgr2 restrictions of input data
+type InputRestrictions struct {
+	RunWhitelist   []int
+	RunBlacklist   []int
+	LumiList       LumiMask
+	BlockWhitelist []string
+	BlockBlacklist []string
+}
+
+// helper function to check if restrictions are not set
+func (r *InputRestrictions) empty() bool {
+	return len(r.RunWhitelist) == 0 && len(r.RunBlacklist) == 0 && len(r.LumiList) == 0 &&
+		len(r.BlockWhitelist) == 0 && len(r.BlockBlacklist) == 0
+}
+
+// helper function to check if restrictions apply to run/lumi level
+func (r *InputRestrictions) lumiLevel() bool {
+	return len(r.RunWhitelist) != 0 || len(r.RunBlacklist) != 0 || len(r.LumiList) != 0
+}
+
+// helper function to check if given block passes the restrictions
+func (r *InputRestrictions) acceptBlock(blk string) bool {
+	if len(r.BlockWhitelist) != 0 && !InList(blk, r.BlockWhitelist) {
+		return false
+	}
+	return !InList(blk, r.BlockBlacklist)
+}
+
+// helper function to check if given run/lumi pair passes the restrictions
+func (r *InputRestrictions) acceptLumi(run, lumi int) bool {
+	if len(r.RunWhitelist) != 0 && !InList(run, r.RunWhitelist) {
+		return false
+	}
+	if InList(run, r.RunBlacklist) {
+		return false
+	}
+	if len(r.LumiList) != 0 {
+		for _, lumiRange := range r.LumiList[run] {
+			if lumi >= lumiRange[0] && lumi <= lumiRange[1] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// helper function to get run/lumi pairs of input dataset accepted by the
+// restrictions
+func (r *InputRestrictions) acceptedLumis(istats *DBSRecord) RunLumiSet {
+	if r.empty() {
+		return istats.lumis
+	}
+	out := make(RunLumiSet)
+	for i, blk := range istats.blockNames {
+		if i >= len(istats.blockLumis) || !r.acceptBlock(blk) {
+			continue
+		}
+		for _, rec := range istats.blockLumis[i] {
+			if r.acceptLumi(rec.Run, rec.Lumi) && istats.lumis.Contains(rec.Run, rec.Lumi) {
+				out.Add(rec.Run, rec.Lumi)
+			}
+		}
+	}
+	return out
+}
+
+// Task represents task (TaskChain) or step (StepChain) structure of ReqMgr2
 type Task struct {
-	InputDataset string
+	Key                   string `json:"-"` // task key, e.g. Task1 or Step2
+	TaskName              string
+	StepName              string
+	InputDataset          string
+	InputTask             string
+	InputStep             string
+	InputFromOutputModule string
+	KeepOutput            *bool
+	AcquisitionEra        string
+	ProcessingString      string
+	ProcessingVersion     int
+	RequestNumEvents      int64
+	EventsPerLumi         Number
+	FilterEfficiency      Number
+	MCPileup              Text
+	DataPileup            Text
+	InputRestrictions
+}
+
+// Name returns task or step name
+func (t *Task) Name() string {
+	if t.StepName != "" {
+		return t.StepName
+	}
+	return t.TaskName
+}
+
+// Parent returns name of parent task or step
+func (t *Task) Parent() string {
+	if t.InputStep != "" {
+		return t.InputStep
+	}
+	return t.InputTask
+}
+
+// Kept checks if output of the task is kept, by default it is
+func (t *Task) Kept() bool {
+	return t.KeepOutput == nil || *t.KeepOutput
+}
+
+// Number represents numeric ReqMgr2 parameter, some parameters can be
+// either a number or a map of per-task values, the latter are ignored
+type Number float64
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (n *Number) UnmarshalJSON(data []byte) error {
+	var val float64
+	if err := json.Unmarshal(data, &val); err == nil {
+		*n = Number(val)
+	}
+	return nil
+}
+
+// Text represents string ReqMgr2 parameter, some parameters can be either a
+// string or a map of per-task values, the latter are ignored
+type Text string
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (t *Text) UnmarshalJSON(data []byte) error {
+	var val string
+	if err := json.Unmarshal(data, &val); err == nil {
+		*t = Text(val)
+	}
+	return nil
+}
+
+// ChainParentage represents entry of ReqMgr2 ChainParentageMap
+type ChainParentage struct {
+	ParentDset string
+	ChildDsets []string
 }
 
 // ReqMgrRecord represents subset of reqmgr record we need to parse
 type ReqMgrRecord struct {
-	Task1           Task
-	InputDataset    string
-	OutputDatasets  []string
-	TotalInputLumis int
+	RequestType       string
+	InputDataset      string
+	OutputDatasets    []string
+	TotalInputLumis   int
+	RequestNumEvents  int64
+	EventsPerLumi     Number
+	FilterEfficiency  Number
+	MCPileup          Text
+	DataPileup        Text
+	ChainParentageMap map[string]ChainParentage
+	Tasks             []Task `json:"-"` // TaskN or StepN definitions
+	InputRestrictions
+}
+
+// taskPattern represents pattern of TaskChain/StepChain task keys
+var taskPattern = regexp.MustCompile("^(Task|Step)([0-9]+)$")
+
+// UnmarshalJSON implements json.Unmarshaler interface, in addition to
+// fixed set of fields it collects all TaskN and StepN definitions
+func (r *ReqMgrRecord) UnmarshalJSON(data []byte) error {
+	type record ReqMgrRecord
+	var rec record
+	err := json.Unmarshal(data, &rec)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	for key, value := range fields {
+		if !taskPattern.MatchString(key) {
+			continue
+		}
+		var task Task
+		err = json.Unmarshal(value, &task)
+		if err != nil {
+			return fmt.Errorf("unable to parse %s: %w", key, err)
+		}
+		task.Key = key
+		rec.Tasks = append(rec.Tasks, task)
+	}
+	sort.Slice(rec.Tasks, func(i, j int) bool {
+		return taskNumber(rec.Tasks[i].Key) < taskNumber(rec.Tasks[j].Key)
+	})
+	*r = ReqMgrRecord(rec)
+	return nil
+}
+
+// helper function to get number of task from its key, e.g. 2 for Task2
+func taskNumber(key string) int {
+	arr := taskPattern.FindStringSubmatch(key)
+	if len(arr) != 3 {
+		return 0
+	}
+	num, _ := strconv.Atoi(arr[2])
+	return num
+}
+
+// helper function to get input dataset of the request, it is either defined
+// at request level or within first task
+func (r *ReqMgrRecord) inputDataset() string {
+	if r.InputDataset == "" && len(r.Tasks) != 0 {
+		return r.Tasks[0].InputDataset
+	}
+	return r.InputDataset
+}
+
+// helper function to get requested number of events, it is either defined
+// at request level or within first task
+func (r *ReqMgrRecord) requestNumEvents() int64 {
+	if r.RequestNumEvents == 0 && len(r.Tasks) != 0 {
+		return r.Tasks[0].RequestNumEvents
+	}
+	return r.RequestNumEvents
+}
+
+// helper function to get number of events per lumi of the request
+func (r *ReqMgrRecord) eventsPerLumi() float64 {
+	if r.EventsPerLumi == 0 && len(r.Tasks) != 0 {
+		return float64(r.Tasks[0].EventsPerLumi)
+	}
+	return float64(r.EventsPerLumi)
+}
+
+// helper function to get filter efficiency of the request, by default it is 1
+func (r *ReqMgrRecord) filterEfficiency() float64 {
+	eff := r.FilterEfficiency
+	if eff == 0 && len(r.Tasks) != 0 {
+		eff = r.Tasks[0].FilterEfficiency
+	}
+	if eff <= 0 {
+		return 1
+	}
+	return float64(eff)
+}
+
+// helper function to get input restrictions of the request, they are either
+// defined at request level or within first task
+func (r *ReqMgrRecord) inputRestrictions() InputRestrictions {
+	if r.InputRestrictions.empty() && len(r.Tasks) != 0 {
+		return r.Tasks[0].InputRestrictions
+	}
+	return r.InputRestrictions
+}
+
+// ExpectedStats represents expected statistics of output dataset based on
+// input dataset restricted by request white/black lists
+type ExpectedStats struct {
+	NumLumis    int64 `json:"num_lumi"`               // expected number of lumis
+	NumEvents   int64 `json:"num_event"`              // expected number of events
+	NumBlocks   int64 `json:"num_block"`              // number of accepted input blocks
+	Restricted  bool  `json:"restricted"`             // request restricts input data
+	FromScratch bool  `json:"from_scratch,omitempty"` // request has no input dataset (MonteCarlo from scratch)
 }
 
+// helper function to compute expected output statistics of MonteCarlo
+// request without input dataset, the number of events is requested number
+// of events times filter efficiency and number of lumis is requested number
+// of events divided by number of events per lumi
+func mcExpectedStats(rec *ReqMgrRecord) *ExpectedStats {
+	numEvents := rec.requestNumEvents()
+	out := &ExpectedStats{
+		NumEvents:   int64(math.Round(float64(numEvents) * rec.filterEfficiency())),
+		FromScratch: true,
+	}
+	if eventsPerLumi := rec.eventsPerLumi(); eventsPerLumi > 0 {
+		out.NumLumis = int64(math.Ceil(float64(numEvents) / eventsPerLumi))
+	}
+	return out
+}
+
+// helper function to compute expected output statistics of the request from
+// its input dataset statistics. If request restricts input data at run/lumi
+// level and DBS does not provide event counts per lumi, the number of events
+// of a block is estimated proportionally to the number of accepted lumis.
+// The lumis and events of invalid files are not accounted, as well as they
+// are not part of valid-only DBS statistics of unrestricted input.
+func expectedStats(restrictions InputRestrictions, numEvents int64, istats *DBSRecord) *ExpectedStats {
+	out := &ExpectedStats{
+		NumLumis:   istats.NumLumis,
+		NumEvents:  istats.NumEvents,
+		NumBlocks:  istats.NumBlocks,
+		Restricted: !restrictions.empty(),
+	}
+	if out.Restricted {
+		out.NumLumis, out.NumEvents, out.NumBlocks = 0, 0, 0
+		lumis := make(RunLumiSet)
+		blockLumis := validRunLumis(istats.blockLumis, istats.invalidFiles)
+		for i, blk := range istats.blockNames {
+			if !restrictions.acceptBlock(blk) {
+				continue
+			}
+			out.NumBlocks++
+			var summary Lumi
+			if i < len(istats.blockSummaries) {
+				summary = istats.blockSummaries[i]
+			}
+			if !restrictions.lumiLevel() {
+				out.NumEvents += summary.NumEvent
+			}
+			if i >= len(blockLumis) {
+				continue
+			}
+			var records, accepted, events int64
+			for _, r := range blockLumis[i] {
+				records++
+				if !restrictions.acceptLumi(r.Run, r.Lumi) || !istats.lumis.Contains(r.Run, r.Lumi) {
+					continue
+				}
+				accepted++
+				events += r.Events
+				lumis.Add(r.Run, r.Lumi)
+			}
+			if restrictions.lumiLevel() {
+				if events == 0 && records > 0 {
+					events = summary.NumEvent * accepted / records
+				}
+				out.NumEvents += events
+			}
+		}
+		out.NumLumis = int64(lumis.Len())
+	}
+	if numEvents > 0 && numEvents < out.NumEvents {
+		out.NumEvents = numEvents
+	}
+	return out
+}
+
+// default ReqMgr2 url
+const defaultReqMgrUrl string = "https://cmsweb.cern.ch/reqmgr2"
+
 // helper function to make call to reqmgr service
-func callReqMgr(workflow string, verbose bool) (*ReqMgrRecord, error) {
+func callReqMgr(ctx context.Context, reqmgrUrl, workflow string, verbose bool) (*ReqMgrRecord, error) {
 	// get JSON from reqmgr2 via
-	rurl := fmt.Sprintf("https://cmsweb.cern.ch/reqmgr2/data/request?name=%s", workflow)
+	rurl := fmt.Sprintf("%s/data/request?name=%s", reqmgrUrl, workflow)
 	if verbose {
 		log.Println("rurl", rurl)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*60))
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "GET", rurl, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Accept", "application/json")
-	client := HttpClient(verbose)
-	resp, err := client.Do(req)
-	atomic.AddUint64(&TotalURLCalls, 1)
+	resp, err := upstreamGet(ctx, rurl, "application/json", verbose)
 	if err != nil {
 		if verbose {
-			log.Println("callReqMgr client.Do", err)
+			log.Println("callReqMgr", err)
 		}
 		return nil, err
 	}
 	defer resp.Body.Close()
 	data, err := io.ReadAll(resp.Body)
-	var rec ResultRecord
 	if err != nil {
 		if verbose {
 			log.Println("callReqMgr io.ReadAll", err)
@@ -68,10 +381,16 @@ func callReqMgr(workflow string, verbose bool) (*ReqMgrRecord, error) {
 	if verbose {
 		log.Println("ReqMgr2 data\n", string(data))
 	}
-	err = json.Unmarshal(data, &rec)
+	return parseReqMgr(data, workflow, verbose)
+}
+
+// helper function to parse ReqMgr2 data and extract record of given workflow
+func parseReqMgr(data []byte, workflow string, verbose bool) (*ReqMgrRecord, error) {
+	var rec ResultRecord
+	err := json.Unmarshal(data, &rec)
 	if err != nil {
 		if verbose {
-			log.Println("callReqMgr json.Unmarshal", err)
+			log.Println("parseReqMgr json.Unmarshal", err)
 		}
 		return nil, err
 	}
@@ -82,5 +401,5 @@ func callReqMgr(workflow string, verbose bool) (*ReqMgrRecord, error) {
 			}
 		}
 	}
-	return nil, errors.New("unable to get ReqMgr record")
+	return nil, fmt.Errorf("%s: %w", workflow, ErrWorkflowNotFound)
 }
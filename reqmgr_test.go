@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// helper function to construct input dataset record with two blocks: block
+// #1 of run 1 with lumis 1-4 of 10 events each and block #2 of run 2 with
+// lumis 1-2 without event counts and 30 events in total
+func testInputRecord() *DBSRecord {
+	blockLumis := [][]RunLumi{
+		{{Run: 1, Lumi: 1, Events: 10}, {Run: 1, Lumi: 2, Events: 10}, {Run: 1, Lumi: 3, Events: 10}, {Run: 1, Lumi: 4, Events: 10}},
+		{{Run: 2, Lumi: 1}, {Run: 2, Lumi: 2}},
+	}
+	_, lumis, _ := uniqueRunLumis(blockLumis)
+	return &DBSRecord{
+		NumLumis:       6,
+		NumEvents:      70,
+		NumBlocks:      2,
+		lumis:          lumis,
+		blockNames:     []string{"/A/B/RAW#1", "/A/B/RAW#2"},
+		blockLumis:     blockLumis,
+		blockSummaries: []Lumi{{NumLumi: 4, NumEvent: 40, NumFile: 1}, {NumLumi: 2, NumEvent: 30, NumFile: 1}},
+	}
+}
+
+// TestExpectedStats tests expected output statistics of restricted input
+func TestExpectedStats(t *testing.T) {
+	tests := []struct {
+		name         string
+		restrictions InputRestrictions
+		numEvents    int64
+		expect       ExpectedStats
+	}{
+		{"no restrictions", InputRestrictions{}, 0, ExpectedStats{NumLumis: 6, NumEvents: 70, NumBlocks: 2}},
+		{"request events", InputRestrictions{}, 50, ExpectedStats{NumLumis: 6, NumEvents: 50, NumBlocks: 2}},
+		{"run whitelist", InputRestrictions{RunWhitelist: []int{1}}, 0, ExpectedStats{NumLumis: 4, NumEvents: 40, NumBlocks: 2, Restricted: true}},
+		// events of block without event counts are estimated from accepted lumis
+		{"run blacklist", InputRestrictions{RunBlacklist: []int{1}}, 0, ExpectedStats{NumLumis: 2, NumEvents: 30, NumBlocks: 2, Restricted: true}},
+		{"lumi list", InputRestrictions{LumiList: LumiMask{1: {{2, 3}}, 2: {{2, 2}}}}, 0, ExpectedStats{NumLumis: 3, NumEvents: 35, NumBlocks: 2, Restricted: true}},
+		{"block whitelist", InputRestrictions{BlockWhitelist: []string{"/A/B/RAW#2"}}, 0, ExpectedStats{NumLumis: 2, NumEvents: 30, NumBlocks: 1, Restricted: true}},
+		{"block blacklist", InputRestrictions{BlockBlacklist: []string{"/A/B/RAW#2"}}, 0, ExpectedStats{NumLumis: 4, NumEvents: 40, NumBlocks: 1, Restricted: true}},
+		{"block and run", InputRestrictions{BlockWhitelist: []string{"/A/B/RAW#1"}, RunWhitelist: []int{2}}, 0, ExpectedStats{NumBlocks: 1, Restricted: true}},
+	}
+	for _, tt := range tests {
+		stats := expectedStats(tt.restrictions, tt.numEvents, testInputRecord())
+		if !reflect.DeepEqual(*stats, tt.expect) {
+			t.Errorf("%s: wrong expected stats %+v, expect %+v", tt.name, *stats, tt.expect)
+		}
+	}
+
+	// lumis and events of invalid file, i.e. lost lumi 1:5 and reprocessed
+	// lumi 1:1, are not expected even if restrictions accept them
+	istats := testInputRecord()
+	istats.blockLumis[0] = append(istats.blockLumis[0],
+		RunLumi{Run: 1, Lumi: 1, Events: 10, LFN: "/c.root"},
+		RunLumi{Run: 1, Lumi: 5, Events: 10, LFN: "/c.root"})
+	istats.invalidFiles = []DBSFile{{LogicalFileName: "/c.root", BlockName: "/A/B/RAW#1"}}
+	restrictions := InputRestrictions{RunWhitelist: []int{1, 2}}
+	expect := ExpectedStats{NumLumis: 6, NumEvents: 70, NumBlocks: 2, Restricted: true}
+	if stats := expectedStats(restrictions, 0, istats); !reflect.DeepEqual(*stats, expect) {
+		t.Errorf("invalid file: wrong expected stats %+v, expect %+v", *stats, expect)
+	}
+}
+
+// TestLumiDiffRestrictions tests that lumis excluded by request restrictions
+// are not reported as missing
+func TestLumiDiffRestrictions(t *testing.T) {
+	istats := testInputRecord()
+	ostats := &DBSRecord{lumis: make(RunLumiSet)}
+	for lumi := 1; lumi <= 4; lumi++ {
+		ostats.lumis.Add(1, lumi)
+	}
+	tests := []struct {
+		name         string
+		restrictions InputRestrictions
+		missing      LumiMask
+	}{
+		{"no restrictions", InputRestrictions{}, LumiMask{2: {{1, 2}}}},
+		{"run whitelist", InputRestrictions{RunWhitelist: []int{1}}, LumiMask{}},
+		{"lumi list", InputRestrictions{LumiList: LumiMask{1: {{1, 2}}, 2: {{2, 2}}}}, LumiMask{2: {{2, 2}}}},
+		{"block blacklist", InputRestrictions{BlockBlacklist: []string{"/A/B/RAW#2"}}, LumiMask{}},
+	}
+	for _, tt := range tests {
+		diff := lumiDiff(tt.restrictions, istats, ostats)
+		if !reflect.DeepEqual(diff.Missing, tt.missing) {
+			t.Errorf("%s: wrong missing lumis %v, expect %v", tt.name, diff.Missing, tt.missing)
+		}
+	}
+}
+
+// TestMCExpectedStats tests expected output statistics of MonteCarlo from
+// scratch requests
+func TestMCExpectedStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		expect ExpectedStats
+	}{
+		{"request parameters", `{"RequestNumEvents": 1000, "EventsPerLumi": 100, "FilterEfficiency": 0.5}`, ExpectedStats{NumLumis: 10, NumEvents: 500, FromScratch: true}},
+		{"default filter efficiency", `{"RequestNumEvents": 1000, "EventsPerLumi": 300}`, ExpectedStats{NumLumis: 4, NumEvents: 1000, FromScratch: true}},
+		{"invalid filter efficiency", `{"RequestNumEvents": 1000, "EventsPerLumi": 100, "FilterEfficiency": -1}`, ExpectedStats{NumLumis: 10, NumEvents: 1000, FromScratch: true}},
+		{"no events per lumi", `{"RequestNumEvents": 1000, "FilterEfficiency": 0.5}`, ExpectedStats{NumEvents: 500, FromScratch: true}},
+		// per-task map of filter efficiency is ignored in favor of Task1 value
+		{"task parameters", `{"RequestType": "TaskChain", "FilterEfficiency": {"GEN": 0.7},
+			"Task1": {"TaskName": "GEN", "RequestNumEvents": 310, "EventsPerLumi": 100, "FilterEfficiency": 0.7}}`,
+			ExpectedStats{NumLumis: 4, NumEvents: 217, FromScratch: true}},
+		{"request over task parameters", `{"RequestType": "StepChain", "RequestNumEvents": 200, "EventsPerLumi": 50, "FilterEfficiency": 0.5,
+			"Step1": {"StepName": "GEN", "RequestNumEvents": 310, "EventsPerLumi": 100, "FilterEfficiency": 0.7}}`,
+			ExpectedStats{NumLumis: 4, NumEvents: 100, FromScratch: true}},
+	}
+	for _, tt := range tests {
+		data := fmt.Sprintf(`{"result": [{"wf": %s}]}`, tt.data)
+		rec, err := parseReqMgr([]byte(data), "wf", false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if stats := mcExpectedStats(rec); !reflect.DeepEqual(*stats, tt.expect) {
+			t.Errorf("%s: wrong expected stats %+v, expect %+v", tt.name, *stats, tt.expect)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// default retry and circuit breaker settings of upstream calls
+const (
+	defaultRetries          = 3
+	defaultRetryDelay       = 500 * time.Millisecond
+	defaultRetryMaxDelay    = 10 * time.Second
+	defaultMaxRetryAfter    = 120 * time.Second
+	defaultBreakerThreshold = 10
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// TotalRetries counts total number of retries of upstream calls
+var TotalRetries uint64
+
+// ErrCircuitOpen represents error of calls to upstream service which is
+// considered to be down
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// RetryPolicy represents retry settings of upstream calls
+type RetryPolicy struct {
+	Retries       int           // max number of retries
+	Delay         time.Duration // base delay of exponential backoff
+	MaxDelay      time.Duration // max delay of exponential backoff
+	MaxRetryAfter time.Duration // max delay requested by Retry-After header we wait for
+}
+
+// helper function to get retry policy from server configuration
+func retryPolicy() RetryPolicy {
+	policy := RetryPolicy{
+		Retries:       defaultRetries,
+		Delay:         defaultRetryDelay,
+		MaxDelay:      defaultRetryMaxDelay,
+		MaxRetryAfter: defaultMaxRetryAfter,
+	}
+	if Config.Retries != 0 {
+		// negative number of retries disables retries
+		policy.Retries = Config.Retries
+		if policy.Retries < 0 {
+			policy.Retries = 0
+		}
+	}
+	if Config.RetryDelay > 0 {
+		policy.Delay = time.Duration(Config.RetryDelay) * time.Millisecond
+	}
+	if Config.RetryMaxDelay > 0 {
+		policy.MaxDelay = time.Duration(Config.RetryMaxDelay) * time.Millisecond
+	}
+	if Config.MaxRetryAfter > 0 {
+		policy.MaxRetryAfter = time.Duration(Config.MaxRetryAfter) * time.Second
+	}
+	return policy
+}
+
+// Backoff returns jittered exponential delay before given retry attempt
+// (starting from 1), i.e. random delay between half and full of base delay
+// multiplied by 2^(attempt-1) but no more than max delay
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.Delay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// CircuitBreaker keeps track of consecutive failures of upstream services,
+// when number of failures reaches the threshold the calls to the service
+// fail fast until cooldown period is over, after that a single trial call is
+// allowed. The services are identified by their base url since different
+// services, e.g. DBS and ReqMgr2, can share the same host.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	failures  map[string]int       // number of consecutive failures per service
+	openUntil map[string]time.Time // time until breaker is open per service
+}
+
+// circuitBreaker represents circuit breaker of upstream calls
+var circuitBreaker = &CircuitBreaker{
+	failures:  make(map[string]int),
+	openUntil: make(map[string]time.Time),
+}
+
+// helper function to get circuit breaker settings from server configuration
+func breakerSettings() (int, time.Duration) {
+	threshold := defaultBreakerThreshold
+	if Config.BreakerThreshold > 0 {
+		threshold = Config.BreakerThreshold
+	}
+	cooldown := defaultBreakerCooldown
+	if Config.BreakerCooldown > 0 {
+		cooldown = time.Duration(Config.BreakerCooldown) * time.Second
+	}
+	return threshold, cooldown
+}
+
+// Allow checks if call to given service is allowed
+func (b *CircuitBreaker) Allow(service string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.openUntil[service]
+	if !ok {
+		return true
+	}
+	if time.Now().Before(until) {
+		return false
+	}
+	// cooldown is over, allow single trial call and keep breaker open
+	// until its result is known
+	_, cooldown := breakerSettings()
+	b.openUntil[service] = time.Now().Add(cooldown)
+	return true
+}
+
+// Success records successful call to given service
+func (b *CircuitBreaker) Success(service string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, service)
+	delete(b.openUntil, service)
+}
+
+// Failure records failed call to given service, the breaker is opened when
+// number of failures reaches the threshold. The failures of calls made while
+// breaker is open (e.g. trial call or calls started before breaker was
+// opened) do not extend its cooldown period.
+func (b *CircuitBreaker) Failure(service string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	threshold, cooldown := breakerSettings()
+	b.failures[service]++
+	if _, open := b.openUntil[service]; !open && b.failures[service] >= threshold {
+		b.openUntil[service] = time.Now().Add(cooldown)
+	}
+}
+
+// helper function to get base url of upstream service of given API url,
+// i.e. url without query and API name, e.g.
+// https://cmsweb.cern.ch/dbs/prod/global/DBSReader for blocks API of DBS
+func serviceUrl(u *url.URL) string {
+	path := u.Path
+	if idx := strings.LastIndex(path, "/"); idx >= 0 {
+		path = path[:idx]
+	}
+	return fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, path)
+}
+
+// helper function to check if HTTP status code of upstream call is transient
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// helper function to parse Retry-After header which can be either number
+// of seconds or HTTP date
+func retryAfter(resp *http.Response) time.Duration {
+	val := resp.Header.Get("Retry-After")
+	if val == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(val); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// helper function to perform HTTP GET request to upstream service. The
+// transient failures (network errors and 429, 502, 503, 504 HTTP codes) are
+// retried with jittered exponential backoff (or delay requested by
+// Retry-After header unless it exceeds max delay of retry policy), while
+// calls to services with too many consecutive failures fail fast. It returns response with 2xx status code or error,
+// the caller is responsible to close response body.
+func upstreamGet(ctx context.Context, rurl, accept string, verbose bool) (*http.Response, error) {
+	var host, service string
+	if u, err := url.Parse(rurl); err == nil {
+		host = u.Host
+		service = serviceUrl(u)
+	}
+	policy := retryPolicy()
+	client := HttpClient(verbose)
+	rlimiter, hlimiter := limiters()
+	for attempt := 0; ; attempt++ {
+		if !circuitBreaker.Allow(service) {
+			return nil, fmt.Errorf("%s: %w for %s", rurl, ErrCircuitOpen, service)
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", rurl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Accept", accept)
+		// the host slot is held until response body is closed
+		if err := rlimiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		release, err := hlimiter.Acquire(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		atomic.AddUint64(&TotalURLCalls, 1)
+		var delay time.Duration
+		if err == nil {
+			if !retryableStatus(resp.StatusCode) {
+				circuitBreaker.Success(service)
+				if attempt > 0 && verbose {
+					log.Printf("%s succeeded after %d retries", rurl, attempt)
+				}
+				if err := checkResponse(rurl, resp); err != nil {
+					resp.Body.Close()
+					release()
+					return nil, err
+				}
+				resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+				return resp, nil
+			}
+			delay = retryAfter(resp)
+			err = checkResponse(rurl, resp)
+			resp.Body.Close()
+		}
+		release()
+		if ctx.Err() != nil {
+			// cancelled calls are not failures of upstream service
+			return nil, ctx.Err()
+		}
+		if err != nil && !retryableError(err) {
+			return nil, err
+		}
+		circuitBreaker.Failure(service)
+		if attempt >= policy.Retries {
+			if verbose && attempt > 0 {
+				log.Printf("%s failed after %d retries", rurl, attempt)
+			}
+			return nil, err
+		}
+		if delay > policy.MaxRetryAfter {
+			// we do not wait longer than allowed by retry policy
+			if verbose {
+				log.Printf("%s requested retry after %s, give up: %v", rurl, delay, err)
+			}
+			return nil, err
+		}
+		if backoff := policy.Backoff(attempt + 1); delay < backoff {
+			delay = backoff
+		}
+		atomic.AddUint64(&TotalRetries, 1)
+		if verbose {
+			log.Printf("retry %d/%d of %s in %s: %v", attempt+1, policy.Retries, rurl, delay, err)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// helper function to check if error of upstream call is transient, i.e.
+// network error, timeout or HTTP error with transient status code, while
+// e.g. cancellation, TLS verification or malformed url errors are not
+func retryableError(err error) bool {
+	var herr *HTTPError
+	if errors.As(err, &herr) {
+		return retryableStatus(herr.StatusCode)
+	}
+	var verr *TLSVerificationError
+	if errors.As(err, &verr) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	// url.Error implements net.Error interface, therefore we check error
+	// wrapped by it
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		err = uerr.Err
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		// connection closed by upstream or timed out
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
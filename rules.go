@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// severity levels of status evaluation
+const (
+	StatusOK      = "OK"
+	StatusWarning = "WARNING"
+	StatusError   = "ERROR"
+)
+
+// Rule represents rule of status evaluation engine. The rule compares value
+// of a metric with expected value which is either threshold fraction of
+// reference metric value or, if reference is not provided, threshold itself.
+// The rules whose metrics are not available for a record are skipped.
+type Rule struct {
+	Name      string   `json:"name" yaml:"name"`           // rule name
+	Metric    string   `json:"metric" yaml:"metric"`       // metric name, e.g. output.num_lumi
+	Op        string   `json:"op" yaml:"op"`               // comparison operator: eq, ne, ge, gt, le, lt
+	Reference string   `json:"reference" yaml:"reference"` // reference metric name, e.g. input.num_lumi
+	Threshold float64  `json:"threshold" yaml:"threshold"` // fraction of reference value or absolute value
+	Tiers     []string `json:"tiers" yaml:"tiers"`         // output data-tiers rule applies to, empty means all
+	Severity  string   `json:"severity" yaml:"severity"`   // severity of failed rule: WARNING or ERROR
+}
+
+// RuleResult represents result of rule evaluation
+type RuleResult struct {
+	Rule     string `json:"rule"`              // rule name
+	Dataset  string `json:"dataset,omitempty"` // dataset rule applies to if it is not output dataset
+	Severity string `json:"severity"`          // OK if rule is satisfied and rule severity otherwise
+	Expected any    `json:"expected"`          // expected value
+	Actual   any    `json:"actual"`            // actual value
+}
+
+// defaultRules represents default set of status rules, i.e. number of lumis
+// and events of output dataset should be equal to those expected from
+// (restricted) input dataset and to ReqMgr2 TotalInputLumis, while
+// MonteCarlo from scratch output should have all requested lumis and at
+// least 95% of expected events. The output lumis should not be present in
+// more than one file. The output files should have parents which
+// belong to the parent dataset and every parent file should have one child.
+var defaultRules = []Rule{
+	{Name: "num_lumi", Metric: "output.num_lumi", Op: "eq", Reference: "expected.num_lumi", Threshold: 1, Severity: StatusWarning},
+	{Name: "num_event", Metric: "output.num_event", Op: "eq", Reference: "expected.num_event", Threshold: 1, Severity: StatusWarning},
+	{Name: "total_input_lumis", Metric: "output.num_lumi", Op: "eq", Reference: "request.total_input_lumis", Threshold: 1, Severity: StatusWarning},
+	{Name: "mc_num_lumi", Metric: "output.num_lumi", Op: "ge", Reference: "mc.num_lumi", Threshold: 1, Severity: StatusWarning},
+	{Name: "mc_completion", Metric: "mc.completion", Op: "ge", Threshold: 95, Severity: StatusWarning},
+	{Name: "duplicated_lumis", Metric: "output.num_duplicated_lumis", Op: "eq", Threshold: 0, Severity: StatusWarning},
+	{Name: "lineage_parent_dataset", Metric: "lineage.parent_dataset", Op: "eq", Threshold: 1, Severity: StatusWarning},
+	{Name: "lineage_orphan_files", Metric: "lineage.orphan_files", Op: "eq", Threshold: 0, Severity: StatusWarning},
+	{Name: "lineage_foreign_parents", Metric: "lineage.foreign_parents", Op: "eq", Threshold: 0, Severity: StatusWarning},
+	{Name: "lineage_multi_parented", Metric: "lineage.multi_parented", Op: "eq", Threshold: 0, Severity: StatusWarning},
+}
+
+// StatusRules represents rules used to evaluate status of records
+var StatusRules = defaultRules
+
+// helper function to load status rules from JSON or YAML file, the threshold
+// of rule with reference metric defaults to 1, i.e. the metric is compared
+// with reference value itself
+func loadRules(fname string) ([]Rule, error) {
+	data, err := os.ReadFile(filepath.Clean(fname))
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	// rules fields are used to find out which rules do not define threshold
+	var fields []map[string]any
+	unmarshal := json.Unmarshal
+	ext := strings.ToLower(filepath.Ext(fname))
+	if ext == ".yaml" || ext == ".yml" {
+		unmarshal = yaml.Unmarshal
+	}
+	err = unmarshal(data, &rules)
+	if err == nil {
+		err = unmarshal(data, &fields)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse rules file %s: %w", fname, err)
+	}
+	for i := range rules {
+		if _, ok := fields[i]["threshold"]; !ok && rules[i].Reference != "" {
+			rules[i].Threshold = 1
+		}
+	}
+	for i, r := range rules {
+		if r.Name == "" || r.Metric == "" {
+			return nil, fmt.Errorf("rule #%d: name and metric are required", i)
+		}
+		if _, ok := ruleOps[r.Op]; !ok {
+			return nil, fmt.Errorf("rule %s: unsupported operator '%s'", r.Name, r.Op)
+		}
+		if r.Severity != StatusWarning && r.Severity != StatusError {
+			return nil, fmt.Errorf("rule %s: unsupported severity '%s'", r.Name, r.Severity)
+		}
+	}
+	return rules, nil
+}
+
+// ruleOps represents comparison operators supported by rules
+var ruleOps = map[string]func(a, b float64) bool{
+	"eq": func(a, b float64) bool { return math.Abs(a-b) < 1e-9 },
+	"ne": func(a, b float64) bool { return math.Abs(a-b) >= 1e-9 },
+	"ge": func(a, b float64) bool { return a >= b },
+	"gt": func(a, b float64) bool { return a > b },
+	"le": func(a, b float64) bool { return a <= b },
+	"lt": func(a, b float64) bool { return a < b },
+}
+
+// helper function to get data-tier of given dataset
+func dataTier(dataset string) string {
+	arr := strings.Split(dataset, "/")
+	return arr[len(arr)-1]
+}
+
+// helper function to add DBS record metrics with given prefix
+func statsMetrics(metrics map[string]float64, prefix string, rec *DBSRecord) {
+	metrics[prefix+".num_lumi"] = float64(rec.NumLumis)
+	metrics[prefix+".num_file"] = float64(rec.NumFiles)
+	metrics[prefix+".num_event"] = float64(rec.NumEvents)
+	metrics[prefix+".num_block"] = float64(rec.NumBlocks)
+	metrics[prefix+".num_file_lumis"] = float64(rec.TotalFileLumis)
+	metrics[prefix+".unique_file_lumis"] = float64(rec.UniqueFileLumis)
+	metrics[prefix+".filesummaries_lumis"] = float64(rec.FilesummariesLumis)
+	metrics[prefix+".num_invalid_files"] = float64(rec.NumInvalidFiles)
+	metrics[prefix+".num_duplicated_lumis"] = float64(rec.NumDuplicatedLumis)
+	metrics[prefix+".num_duplicated_events"] = float64(rec.NumDuplicatedEvents)
+	metrics[prefix+".num_lost_lumis"] = float64(rec.NumLostLumis)
+	// number of files of dataset statistics includes only valid files
+	if total := rec.NumFiles + rec.NumInvalidFiles; total > 0 {
+		metrics[prefix+".invalid_file_ratio"] = float64(rec.NumInvalidFiles) / float64(total)
+	}
+}
+
+// helper function to add lineage metrics of output dataset
+func lineageMetrics(metrics map[string]float64, lineage *Lineage) {
+	metrics["lineage.parent_dataset"] = 0
+	if InList(lineage.ParentDataset, lineage.ParentDatasets) {
+		metrics["lineage.parent_dataset"] = 1
+	}
+	metrics["lineage.orphan_files"] = float64(lineage.NumOrphanFiles)
+	metrics["lineage.foreign_parents"] = float64(lineage.NumForeignParents)
+	metrics["lineage.multi_parented"] = float64(lineage.NumMultiParented)
+}
+
+// helper function to get metrics of a record used by status rules
+func recordMetrics(rec *Record) map[string]float64 {
+	metrics := make(map[string]float64)
+	statsMetrics(metrics, "input", &rec.InputStats)
+	statsMetrics(metrics, "output", &rec.OutputStats)
+	if rec.TotalInputLumis > 0 {
+		metrics["request.total_input_lumis"] = float64(rec.TotalInputLumis)
+	}
+	if rec.RequestNumEvents > 0 {
+		metrics["request.num_events"] = float64(rec.RequestNumEvents)
+	}
+	if rec.ExpectedStats != nil && rec.ExpectedStats.FromScratch {
+		metrics["mc.num_lumi"] = float64(rec.ExpectedStats.NumLumis)
+		metrics["mc.num_event"] = float64(rec.ExpectedStats.NumEvents)
+		if rec.ExpectedStats.NumEvents > 0 {
+			metrics["mc.completion"] = rec.Completion
+		}
+	} else if rec.ExpectedStats != nil {
+		metrics["expected.num_lumi"] = float64(rec.ExpectedStats.NumLumis)
+		metrics["expected.num_event"] = float64(rec.ExpectedStats.NumEvents)
+		metrics["expected.num_block"] = float64(rec.ExpectedStats.NumBlocks)
+		if rec.ExpectedStats.NumEvents > 0 {
+			metrics["completion"] = rec.Completion
+		}
+	}
+	if rec.InputDataset == "" {
+		for key := range metrics {
+			if strings.HasPrefix(key, "input.") {
+				delete(metrics, key)
+			}
+		}
+	}
+	if rec.LumiDiff != nil {
+		metrics["lumis.missing"] = float64(rec.LumiDiff.NumMissing)
+		metrics["lumis.extra"] = float64(rec.LumiDiff.NumExtra)
+		metrics["lumis.duplicated"] = float64(rec.LumiDiff.NumDuplicated)
+	}
+	if rec.OutputStats.Lineage != nil {
+		lineageMetrics(metrics, rec.OutputStats.Lineage)
+	}
+	return metrics
+}
+
+// helper function to evaluate rules for given record, it returns list of
+// rule results and overall status, i.e. highest severity of failed rules
+func evalRules(rules []Rule, rec *Record) ([]RuleResult, string) {
+	var out []RuleResult
+	metrics := recordMetrics(rec)
+	tier := dataTier(rec.OutputDataset)
+	for _, r := range rules {
+		if len(r.Tiers) != 0 && !InList(tier, r.Tiers) {
+			continue
+		}
+		actual, ok := metrics[r.Metric]
+		if !ok {
+			continue
+		}
+		expected := r.Threshold
+		if r.Reference != "" {
+			ref, ok := metrics[r.Reference]
+			if !ok {
+				continue
+			}
+			expected = r.Threshold * ref
+		}
+		cmp, ok := ruleOps[r.Op]
+		if !ok {
+			continue
+		}
+		res := RuleResult{Rule: r.Name, Severity: StatusOK, Expected: expected, Actual: actual}
+		if !cmp(actual, expected) {
+			res.Severity = r.Severity
+		}
+		out = append(out, res)
+	}
+	if res, ok := accessTypeResult(rec.OutputStats.AccessType); ok {
+		out = append(out, res)
+	}
+	out = append(out, pileupResults(rec.PileupStats)...)
+	if len(rec.FailedBlocks) != 0 {
+		out = append(out, RuleResult{
+			Rule:     "failed_blocks",
+			Severity: StatusError,
+			Expected: 0,
+			Actual:   len(rec.FailedBlocks),
+		})
+	}
+	return out, recordStatus(out)
+}
+
+// helper function to check DBS access type of output dataset, the dataset
+// which is still in PRODUCTION raises warning while INVALID or DEPRECATED
+// dataset raises error
+func accessTypeResult(accessType string) (RuleResult, bool) {
+	if accessType == "" {
+		return RuleResult{}, false
+	}
+	res := RuleResult{
+		Rule:     "access_type",
+		Severity: StatusOK,
+		Expected: "VALID",
+		Actual:   accessType,
+	}
+	switch accessType {
+	case "VALID":
+	case "INVALID", "DEPRECATED":
+		res.Severity = StatusError
+	default:
+		res.Severity = StatusWarning
+	}
+	return res, true
+}
+
+// helper function to get overall status of given rule results
+func recordStatus(results []RuleResult) string {
+	status := StatusOK
+	for _, r := range results {
+		if r.Severity == StatusError {
+			return StatusError
+		}
+		if r.Severity == StatusWarning {
+			status = StatusWarning
+		}
+	}
+	return status
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadRules tests loading of status rules from JSON and YAML files
+func TestLoadRules(t *testing.T) {
+	files := map[string]string{
+		"rules.json": `[
+			{"name": "lumis", "metric": "output.num_lumi", "op": "ge", "reference": "request.total_input_lumis", "severity": "ERROR"},
+			{"name": "events", "metric": "output.num_event", "op": "ge", "reference": "expected.num_event", "threshold": 0.9, "severity": "WARNING"},
+			{"name": "invalid", "metric": "output.num_invalid_files", "op": "eq", "severity": "WARNING"}
+		]`,
+		"rules.yaml": `
+- name: lumis
+  metric: output.num_lumi
+  op: ge
+  reference: request.total_input_lumis
+  severity: ERROR
+- name: events
+  metric: output.num_event
+  op: ge
+  reference: expected.num_event
+  threshold: 0.9
+  severity: WARNING
+- name: invalid
+  metric: output.num_invalid_files
+  op: eq
+  severity: WARNING
+`,
+	}
+	dir := t.TempDir()
+	for name, data := range files {
+		fname := filepath.Join(dir, name)
+		if err := os.WriteFile(fname, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := loadRules(fname)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(rules) != 3 {
+			t.Fatalf("%s: wrong number of rules %d", name, len(rules))
+		}
+		// threshold of reference rule defaults to 1
+		for i, threshold := range []float64{1, 0.9, 0} {
+			if rules[i].Threshold != threshold {
+				t.Errorf("%s: wrong threshold %v of rule %s, expect %v", name, rules[i].Threshold, rules[i].Name, threshold)
+			}
+		}
+		if rules[0].Severity != StatusError || rules[1].Reference != "expected.num_event" {
+			t.Errorf("%s: wrong rules %+v", name, rules)
+		}
+	}
+
+	invalid := []string{
+		`[{"name": "lumis", "metric": "output.num_lumi", "op": "approx", "severity": "ERROR"}]`,
+		`[{"name": "lumis", "metric": "output.num_lumi", "op": "eq", "severity": "FATAL"}]`,
+		`[{"name": "lumis", "op": "eq", "severity": "ERROR"}]`,
+		`{"name": "lumis"}`,
+	}
+	for i, data := range invalid {
+		fname := filepath.Join(dir, "invalid.json")
+		if err := os.WriteFile(fname, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadRules(fname); err == nil {
+			t.Errorf("no error for invalid rules #%d", i)
+		}
+	}
+}
+
+// TestEvalRules tests evaluation of status rules
+func TestEvalRules(t *testing.T) {
+	rules := []Rule{
+		{Name: "num_lumi", Metric: "output.num_lumi", Op: "eq", Reference: "input.num_lumi", Threshold: 1, Severity: StatusWarning},
+		{Name: "num_event", Metric: "output.num_event", Op: "ge", Reference: "input.num_event", Threshold: 0.9, Severity: StatusError},
+		{Name: "nano_files", Metric: "output.num_invalid_files", Op: "eq", Tiers: []string{"NANOAOD"}, Severity: StatusError},
+		{Name: "mc_completion", Metric: "mc.completion", Op: "ge", Threshold: 95, Severity: StatusWarning},
+	}
+	tests := []struct {
+		name   string
+		rec    Record
+		status string
+		checks int
+	}{
+		{
+			name:   "matching output",
+			rec:    Record{InputDataset: "/A/B/RAW", OutputDataset: "/A/C/AOD", InputStats: DBSRecord{NumLumis: 10, NumEvents: 100}, OutputStats: DBSRecord{NumLumis: 10, NumEvents: 95, NumInvalidFiles: 1}},
+			status: StatusOK,
+			checks: 2,
+		},
+		{
+			name:   "missing lumis",
+			rec:    Record{InputDataset: "/A/B/RAW", OutputDataset: "/A/C/AOD", InputStats: DBSRecord{NumLumis: 10, NumEvents: 100}, OutputStats: DBSRecord{NumLumis: 9, NumEvents: 95}},
+			status: StatusWarning,
+			checks: 2,
+		},
+		{
+			name:   "invalid nano files",
+			rec:    Record{InputDataset: "/A/B/RAW", OutputDataset: "/A/C/NANOAOD", InputStats: DBSRecord{NumLumis: 10, NumEvents: 100}, OutputStats: DBSRecord{NumLumis: 9, NumEvents: 95, NumInvalidFiles: 1}},
+			status: StatusError,
+			checks: 3,
+		},
+		{
+			// input metrics are not available for request without input dataset
+			name:   "no input dataset",
+			rec:    Record{OutputDataset: "/A/C/AOD", OutputStats: DBSRecord{NumLumis: 9, NumEvents: 95}},
+			status: StatusOK,
+			checks: 0,
+		},
+		{
+			name:   "invalid output",
+			rec:    Record{OutputDataset: "/A/C/AOD", OutputStats: DBSRecord{AccessType: "INVALID"}},
+			status: StatusError,
+			checks: 1,
+		},
+		{
+			name:   "failed blocks",
+			rec:    Record{OutputDataset: "/A/C/AOD", OutputStats: DBSRecord{AccessType: "PRODUCTION"}, FailedBlocks: []string{"/A/C/AOD#1"}},
+			status: StatusError,
+			checks: 2,
+		},
+	}
+	for _, tt := range tests {
+		checks, status := evalRules(rules, &tt.rec)
+		if status != tt.status || len(checks) != tt.checks {
+			t.Errorf("%s: wrong status %s or checks %+v", tt.name, status, checks)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WorkflowSource represents source of ReqMgr2 workflow records
+type WorkflowSource interface {
+	Workflow(ctx context.Context, name string) (*ReqMgrRecord, error)
+}
+
+// DatasetStatsSource represents source of DBS dataset statistics
+type DatasetStatsSource interface {
+	DatasetStats(ctx context.Context, dataset string) (*DBSRecord, error)
+	PileupStats(ctx context.Context, dataset string) (*PileupRecord, error)
+	DatasetLineage(ctx context.Context, dataset, parent string, blocks []string) (*Lineage, error)
+}
+
+// ReqMgrSource implements WorkflowSource interface using ReqMgr2 HTTP APIs
+type ReqMgrSource struct {
+	Url     string // ReqMgr2 url
+	Verbose bool   // verbose mode
+}
+
+// Workflow implements WorkflowSource interface
+func (s *ReqMgrSource) Workflow(ctx context.Context, name string) (*ReqMgrRecord, error) {
+	return callReqMgr(ctx, s.Url, name, s.Verbose)
+}
+
+// DBSSource implements DatasetStatsSource interface using DBS HTTP APIs
+type DBSSource struct {
+	Url     string  // DBS url
+	Details Details // optional details of DBS statistics
+	Verbose bool    // verbose mode
+}
+
+// DatasetStats implements DatasetStatsSource interface
+func (s *DBSSource) DatasetStats(ctx context.Context, dataset string) (*DBSRecord, error) {
+	return dbsStats(ctx, s.Url, dataset, s.Details, s.Verbose)
+}
+
+// PileupStats implements DatasetStatsSource interface
+func (s *DBSSource) PileupStats(ctx context.Context, dataset string) (*PileupRecord, error) {
+	return dbsPileupStats(ctx, s.Url, dataset, s.Verbose)
+}
+
+// DatasetLineage implements DatasetStatsSource interface
+func (s *DBSSource) DatasetLineage(ctx context.Context, dataset, parent string, blocks []string) (*Lineage, error) {
+	return dbsLineage(ctx, s.Url, dataset, parent, blocks, s.Verbose)
+}
+
+// FileSource implements WorkflowSource and DatasetStatsSource interfaces
+// using ReqMgr2 and DBS responses stored in a local directory:
+//
+//	<dir>/reqmgr/<workflow>.json
+//	<dir>/dbs/<api>/<query>.json, e.g. dbs/blocks/dataset=%2FA%2FB%2FC.json
+//
+// where query is URL encoded (with sorted keys) query of DBS API call
+type FileSource struct {
+	Dir     string  // fixtures directory
+	Details Details // optional details of DBS statistics
+	Verbose bool    // verbose mode
+}
+
+// Workflow implements WorkflowSource interface
+func (s *FileSource) Workflow(ctx context.Context, name string) (*ReqMgrRecord, error) {
+	// workflow name comes from user input and it should not point to
+	// files outside of fixtures directory
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return nil, fmt.Errorf("invalid workflow name '%s': %w", name, ErrWorkflowNotFound)
+	}
+	fname := filepath.Join(s.Dir, "reqmgr", fmt.Sprintf("%s.json", name))
+	if s.Verbose {
+		log.Println("read", fname)
+	}
+	data, err := os.ReadFile(filepath.Clean(fname))
+	if err != nil {
+		return nil, err
+	}
+	return parseReqMgr(data, name, s.Verbose)
+}
+
+// DatasetStats implements DatasetStatsSource interface
+func (s *FileSource) DatasetStats(ctx context.Context, dataset string) (*DBSRecord, error) {
+	return dbsStats(ctx, s.dbsUrl(), dataset, s.Details, s.Verbose)
+}
+
+// PileupStats implements DatasetStatsSource interface
+func (s *FileSource) PileupStats(ctx context.Context, dataset string) (*PileupRecord, error) {
+	return dbsPileupStats(ctx, s.dbsUrl(), dataset, s.Verbose)
+}
+
+// DatasetLineage implements DatasetStatsSource interface
+func (s *FileSource) DatasetLineage(ctx context.Context, dataset, parent string, blocks []string) (*Lineage, error) {
+	return dbsLineage(ctx, s.dbsUrl(), dataset, parent, blocks, s.Verbose)
+}
+
+// helper function to get DBS url pointing to fixtures directory, the DBS
+// calls with file scheme are served by fileTransport
+func (s *FileSource) dbsUrl() string {
+	dir, err := filepath.Abs(s.Dir)
+	if err != nil {
+		dir = s.Dir
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(dir, "dbs"))}
+	return u.String()
+}
+
+// Details represents optional details of DBS statistics
+type Details struct {
+	Blocks       bool // include per-block statistics
+	InvalidFiles bool // include invalid files report
+}
+
+// helper function to parse comma separated list of details, e.g.
+// blocks,invalid_files
+func parseDetails(detail string) (Details, error) {
+	var details Details
+	for _, d := range strings.Split(detail, ",") {
+		switch strings.TrimSpace(d) {
+		case "":
+		case "blocks":
+			details.Blocks = true
+		case "invalid_files":
+			details.InvalidFiles = true
+		default:
+			return details, fmt.Errorf("unsupported detail '%s', should be one of blocks, invalid_files", d)
+		}
+	}
+	return details, nil
+}
+
+// helper function to construct data sources, if fixtures directory is
+// provided the FileSource is used instead of ReqMgr2 and DBS services
+func newSources(fixtures, reqmgrUrl, dbsUrl string, details Details, verbose bool) (WorkflowSource, DatasetStatsSource) {
+	if fixtures != "" {
+		src := &FileSource{Dir: fixtures, Details: details, Verbose: verbose}
+		return src, src
+	}
+	wsrc := &ReqMgrSource{Url: reqmgrUrl, Verbose: verbose}
+	dsrc := &DBSSource{Url: dbsUrl, Details: details, Verbose: verbose}
+	return wsrc, dsrc
+}
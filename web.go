@@ -28,6 +28,34 @@ type Configuration struct {
 	PoolWorkers int    `json:"poolWorkers"` // number of pool workers
 	PoolTasks   int    `json:"poolTasks"`   // number of pool tasks
 	Verbose     bool   `json:"verbose"`     // verbose mode
+	DBSUrl      string `json:"dbsUrl"`      // DBS url, e.g. https://cmsweb.cern.ch/dbs/prod/global/DBSReader
+	ReqMgrUrl   string `json:"reqmgrUrl"`   // ReqMgr2 url, e.g. https://cmsweb.cern.ch/reqmgr2
+	Fixtures    string `json:"fixtures"`    // directory with ReqMgr2 and DBS responses (offline mode)
+	Record      string `json:"record"`      // directory to record all upstream HTTP calls
+	Replay      string `json:"replay"`      // directory to replay upstream HTTP calls from
+	Rules       string `json:"rules"`       // JSON or YAML file with status rules
+
+	MaxIdleConns        int  `json:"maxIdleConns"`        // max number of idle upstream connections, 0 means no limit
+	MaxIdleConnsPerHost int  `json:"maxIdleConnsPerHost"` // max number of idle upstream connections per host
+	DisableHTTP2        bool `json:"disableHttp2"`        // do not use HTTP/2 for upstream calls
+
+	CAPath   string `json:"caPath"`   // CA certificates directory or bundle file, e.g. /etc/grid-security/certificates
+	Insecure bool   `json:"insecure"` // skip TLS verification of upstream services
+
+	Timeout          int `json:"timeout"`          // timeout of upstream calls in seconds, default 60
+	Retries          int `json:"retries"`          // max number of retries of upstream calls, default 3, negative disables retries
+	RetryDelay       int `json:"retryDelay"`       // base delay of exponential backoff in milliseconds, default 500
+	RetryMaxDelay    int `json:"retryMaxDelay"`    // max delay of exponential backoff in milliseconds, default 10000
+	MaxRetryAfter    int `json:"maxRetryAfter"`    // max delay requested by Retry-After header in seconds, default 120
+	BreakerThreshold int `json:"breakerThreshold"` // number of consecutive failures to open circuit breaker, default 10
+	BreakerCooldown  int `json:"breakerCooldown"`  // time in seconds circuit breaker stays open, default 30
+
+	RateLimit          float64 `json:"rateLimit"`          // max rate of upstream calls per second, 0 means no limit
+	RateBurst          int     `json:"rateBurst"`          // max burst of upstream calls, default is rate limit
+	MaxHostConcurrency int     `json:"maxHostConcurrency"` // max number of concurrent calls per upstream host, default 100
+
+	WorkflowTimeout int `json:"workflowTimeout"` // deadline of workflow check in seconds, default 600
+	MaxWorkflows    int `json:"maxWorkflows"`    // max number of workflows checked concurrently, default 10
 }
 
 // Config variable represents configuration object
@@ -54,6 +82,59 @@ func parseConfig(configFile string) error {
 	return nil
 }
 
+// helper function to setup DBS and ReqMgr2 end-points. The values are taken
+// (in order of precedence) from command line flags, WFLOW_DBS_URL,
+// WFLOW_DBS_INSTANCE and WFLOW_REQMGR_URL environment variables,
+// server configuration and default values
+func initEndpoints(dbsUrl, dbsInstance, reqmgrUrl string) error {
+	if dbsUrl == "" {
+		dbsUrl = os.Getenv("WFLOW_DBS_URL")
+	}
+	if dbsInstance == "" {
+		dbsInstance = os.Getenv("WFLOW_DBS_INSTANCE")
+	}
+	if reqmgrUrl == "" {
+		reqmgrUrl = os.Getenv("WFLOW_REQMGR_URL")
+	}
+	if dbsUrl != "" {
+		Config.DBSUrl = dbsUrl
+	}
+	if reqmgrUrl != "" {
+		Config.ReqMgrUrl = reqmgrUrl
+	}
+	if Config.DBSUrl == "" {
+		Config.DBSUrl = defaultDBSUrl
+	}
+	if Config.ReqMgrUrl == "" {
+		Config.ReqMgrUrl = defaultReqMgrUrl
+	}
+	Config.DBSUrl = strings.TrimSuffix(Config.DBSUrl, "/")
+	Config.ReqMgrUrl = strings.TrimSuffix(Config.ReqMgrUrl, "/")
+	if dbsInstance != "" {
+		rurl, err := dbsInstanceUrl(Config.DBSUrl, dbsInstance)
+		if err != nil {
+			return err
+		}
+		Config.DBSUrl = rurl
+	}
+	return nil
+}
+
+// helper function to get DBS url for given HTTP request, the DBS instance
+// can be overwritten via dbs_instance query parameter, e.g. prod/phys03
+func requestDBSUrl(r *http.Request) (string, error) {
+	instance := r.URL.Query().Get("dbs_instance")
+	if instance == "" {
+		return Config.DBSUrl, nil
+	}
+	if Config.Fixtures != "" {
+		// DBS responses are served from fixtures directory regardless of
+		// DBS instance, therefore we do not allow to change it
+		return "", fmt.Errorf("dbs_instance parameter is not supported in offline mode")
+	}
+	return dbsInstanceUrl(Config.DBSUrl, instance)
+}
+
 // helper function to get base path
 func basePath(api string) string {
 	base := Config.Base
@@ -93,13 +174,7 @@ func Handlers() *mux.Router {
 }
 
 // helper function to start web server
-func server(webConfig string) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	err := parseConfig(webConfig)
-	if err != nil {
-		log.Fatal(err)
-	}
-
+func server() {
 	// static files
 	var templates Templates
 	tmplData := make(map[string]interface{})
@@ -139,7 +214,21 @@ func DataHandler(w http.ResponseWriter, r *http.Request) {
 	time0 := time.Now()
 	var out []Record
 	var workflows []string
-	var err error
+	dbsUrl, err := requestDBSUrl(r)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	details, err := parseDetails(r.URL.Query().Get("detail"))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wsrc, dsrc := newSources(Config.Fixtures, Config.ReqMgrUrl, dbsUrl, details, Config.Verbose)
+	// upstream calls are cancelled when client disconnects
+	ctx := r.Context()
 	if r.Method == "GET" {
 		var workflow string
 		for k, values := range r.URL.Query() {
@@ -151,7 +240,8 @@ func DataHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		out, err = check(workflow, Config.Verbose)
+		workflows = []string{workflow}
+		out, err = concurrentCheck(ctx, workflows, wsrc, dsrc, Config.Verbose)
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -184,7 +274,7 @@ func DataHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		out, err = concurrentCheck(workflows, Config.Verbose)
+		out, err = concurrentCheck(ctx, workflows, wsrc, dsrc, Config.Verbose)
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -201,7 +291,11 @@ func DataHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	// set HTTP headers and data output
+	// set HTTP headers and data output, the partial results, i.e. when some
+	// of workflows fail to be checked, are reported with 207 Multi-Status
 	w.Header().Add("Content-Type", "application/json")
+	if failedRecords(out) != 0 {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
 	w.Write(data)
 }